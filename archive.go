@@ -0,0 +1,313 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var archiveContentTypes = map[string]string{
+	"zip":    "application/zip",
+	"tar":    "application/x-tar",
+	"tar.gz": "application/gzip",
+}
+
+type archiveFile struct {
+	relPath string
+	absPath string
+	info    os.FileInfo
+}
+
+// GET <dir>?archive=zip|tar|tar.gz streams the directory as an archive built
+// on the fly. The files are picked like filelist does, so the path rules,
+// .gitignore files and the walk options in the query apply. Symlinks are
+// stored as links unless follow=true is passed.
+func (self *RootedRPCHandler) sendArchive(req *rpcRequest, dirPath string, responseChannel chan []byte) HttpError {
+	format := archiveFormat("." + req.query.Get("archive"))
+	if format == "" {
+		return NewHttpError(http.StatusBadRequest, "Archive format must be zip, tar or tar.gz")
+	}
+	options := parseWalkOptions(req.query, self.walkExcludes)
+	var files []archiveFile
+	var lock sync.Mutex
+	walker := newFileWalker(self, dirPath, options)
+	walker.emit = func(relPath string, absPath string, f os.FileInfo) {
+		lock.Lock()
+		files = append(files, archiveFile{relPath, absPath, f})
+		lock.Unlock()
+	}
+	walker.Walk()
+	sort.Slice(files, func(i, j int) bool { return files[i].relPath < files[j].relPath })
+
+	name := filepath.Base(dirPath) + "." + format
+	responseChannel <- statusCodeBuffer(200)
+	responseChannel <- headerBuffer(map[string]string{
+		"Content-Type":        archiveContentTypes[format],
+		"Content-Disposition": fmt.Sprintf("attachment; filename=%q", name),
+	})
+	out := bufio.NewWriterSize(&channelWriter{responseChannel}, BUFFER_SIZE)
+	var err error
+	if format == "zip" {
+		err = self.writeZip(out, files, options.follow)
+	} else {
+		err = self.writeTar(out, files, options.follow, format == "tar.gz")
+	}
+	if err != nil {
+		// Too late for an error status, the archive just ends early
+		fmt.Println("Could not write archive of", dirPath, err)
+	}
+	out.Flush()
+	return nil
+}
+
+// The info to store for a file, and its symlink target when stored as a link
+func (self *RootedRPCHandler) archiveInfo(file archiveFile, follow bool) (os.FileInfo, string, error) {
+	if file.info.Mode()&os.ModeSymlink == 0 {
+		return file.info, "", nil
+	}
+	if follow {
+		info, err := self.fs.Stat(file.absPath)
+		return info, "", err
+	}
+	target, err := self.fs.Readlink(file.absPath)
+	return file.info, target, err
+}
+
+func (self *RootedRPCHandler) writeZip(out io.Writer, files []archiveFile, follow bool) error {
+	archive := zip.NewWriter(out)
+	for _, file := range files {
+		info, target, err := self.archiveInfo(file, follow)
+		if err != nil {
+			continue
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = file.relPath
+		header.Method = zip.Deflate
+		w, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if target != "" {
+			if _, err := w.Write([]byte(target)); err != nil {
+				return err
+			}
+			continue
+		}
+		f, err := self.fs.Open(file.absPath)
+		if err != nil {
+			continue
+		}
+		_, err = io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func (self *RootedRPCHandler) writeTar(out io.Writer, files []archiveFile, follow bool, compress bool) error {
+	if compress {
+		gz := gzip.NewWriter(out)
+		defer gz.Close()
+		out = gz
+	}
+	archive := tar.NewWriter(out)
+	for _, file := range files {
+		info, target, err := self.archiveInfo(file, follow)
+		if err != nil {
+			continue
+		}
+		header, err := tar.FileInfoHeader(info, target)
+		if err != nil {
+			return err
+		}
+		header.Name = file.relPath
+		if target != "" {
+			if err := archive.WriteHeader(header); err != nil {
+				return err
+			}
+			continue
+		}
+		f, err := self.fs.Open(file.absPath)
+		if err != nil {
+			continue
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			f.Close()
+			return err
+		}
+		// The header has the size already, a file changing meanwhile is cut
+		// off or padded with zeros to match it
+		n, err := io.CopyN(archive, f, header.Size)
+		f.Close()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n < header.Size {
+			if _, err := archive.Write(make([]byte, header.Size-n)); err != nil {
+				return err
+			}
+		}
+	}
+	return archive.Close()
+}
+
+// Calls fn for every entry in an archive, open reads the entry's contents
+func walkArchive(f *os.File, format string, fn func(name string, mode os.FileMode, open func() (io.ReadCloser, error)) error) error {
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	if format == "zip" {
+		stat, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		archive, err := zip.NewReader(f, stat.Size())
+		if err != nil {
+			return err
+		}
+		for _, entry := range archive.File {
+			if err := fn(entry.Name, entry.Mode(), entry.Open); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var r io.Reader = f
+	if format == "tar.gz" {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		r = gz
+	}
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		open := func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(archive), nil
+		}
+		if err := fn(header.Name, header.FileInfo().Mode(), open); err != nil {
+			return err
+		}
+	}
+}
+
+// PUT <dir>?archive=zip|tar|tar.gz extracts the archive in the body into the
+// directory, creating it if needed. Every entry has to stay inside the
+// directory and may not be hidden by the path rules, otherwise nothing is
+// extracted. Symlinks and special files in the archive are skipped. Responds
+// with the extracted files, one path per line.
+func (self *RootedRPCHandler) handleExtract(req *rpcRequest, requestChannel chan []byte, responseChannel chan []byte) HttpError {
+	format := archiveFormat("." + req.query.Get("archive"))
+	if format == "" {
+		dropUntilDelimiter(requestChannel)
+		return NewHttpError(http.StatusBadRequest, "Archive format must be zip, tar or tar.gz")
+	}
+	if !self.acquireWriteLock(req.path) {
+		dropUntilDelimiter(requestChannel)
+		return NewHttpError(http.StatusConflict, "Write already going on")
+	}
+	defer self.releaseWriteLock(req.path)
+	dirPath, httpErr := self.resolvePath(req.path)
+	if httpErr != nil {
+		dropUntilDelimiter(requestChannel)
+		return httpErr
+	}
+
+	// Zip needs random access, and checking everything before extracting
+	// needs two passes, so the archive is kept in a temporary file
+	f, err := ioutil.TempFile("", "zedrem-archive")
+	if err != nil {
+		dropUntilDelimiter(requestChannel)
+		return NewHttpError(http.StatusInternalServerError, "Could not create temporary file")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	body := &channelReader{requestChannel: requestChannel}
+	_, err = io.Copy(f, body)
+	body.drain()
+	if err != nil {
+		return NewHttpError(http.StatusInternalServerError, "Could not store archive")
+	}
+
+	targets := make(map[string]string)
+	err = walkArchive(f, format, func(name string, mode os.FileMode, open func() (io.ReadCloser, error)) error {
+		if !mode.IsDir() && !mode.IsRegular() {
+			return nil
+		}
+		target, err := safePath(dirPath, name)
+		if err != nil || (target == dirPath && !mode.IsDir()) {
+			return NewHttpError(http.StatusBadRequest, "Archive entry outside the directory: "+name)
+		}
+		if self.isHidden(target, mode.IsDir()) || isGitPath(self.relativePath(target)) {
+			return NewHttpError(http.StatusForbidden, "Archive entry not allowed: "+name)
+		}
+		targets[name] = target
+		return nil
+	})
+	if httpErr, ok := err.(HttpError); ok {
+		return httpErr
+	} else if err != nil {
+		return NewHttpError(http.StatusBadRequest, "Could not read archive: "+err.Error())
+	}
+
+	if err := self.fs.Mkdir(dirPath, true); err != nil {
+		return fileError(err, "Could not create directory")
+	}
+	var extracted []string
+	err = walkArchive(f, format, func(name string, mode os.FileMode, open func() (io.ReadCloser, error)) error {
+		target, ok := targets[name]
+		if !ok {
+			return nil
+		}
+		if mode.IsDir() {
+			if err := self.fs.Mkdir(target, true); err != nil {
+				return fileError(err, "Could not create directory")
+			}
+			return nil
+		}
+		r, err := open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if httpErr := self.writeFile(target, r); httpErr != nil {
+			return httpErr
+		}
+		extracted = append(extracted, "/"+relativeTo(dirPath, target))
+		return nil
+	})
+	if httpErr, ok := err.(HttpError); ok {
+		return httpErr
+	} else if err != nil {
+		return NewHttpError(http.StatusBadRequest, "Could not read archive: "+err.Error())
+	}
+
+	responseChannel <- statusCodeBuffer(200)
+	responseChannel <- headerBuffer(map[string]string{"Content-Type": "text/plain"})
+	if len(extracted) > 0 {
+		(&channelWriter{responseChannel}).Write([]byte(strings.Join(extracted, "\n") + "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	root := filepath.FromSlash("/project")
+	handler := NewRootedRPCHandler(root, ClientOptions{FileSystem: newMemoryFileSystem(root)})
+	testRequest(handler, "PUT /src/a.txt", "", "a")
+	testRequest(handler, "PUT /src/sub/b.txt", "", "b")
+
+	for _, format := range []string{"zip", "tar", "tar.gz"} {
+		status, archive := testRequest(handler, "GET /src?archive="+format, "", "")
+		if status != 200 {
+			t.Fatalf("Could not get %s archive: %d", format, status)
+		}
+		status, extracted := testRequest(handler, "PUT /"+format+"?archive="+format, "", archive)
+		if status != 200 || extracted != "/a.txt\n/sub/b.txt\n" {
+			t.Errorf("Unexpected %s extraction: %d %q", format, status, extracted)
+		}
+		if _, body := testRequest(handler, "GET /"+format+"/sub/b.txt", "", ""); body != "b" {
+			t.Errorf("Unexpected contents after %s extraction: %q", format, body)
+		}
+	}
+}
+
+func TestExtractOutsideDirectory(t *testing.T) {
+	root := filepath.FromSlash("/project")
+	fs := newMemoryFileSystem(root)
+	handler := NewRootedRPCHandler(root, ClientOptions{FileSystem: fs})
+	var archive bytes.Buffer
+	w := zip.NewWriter(&archive)
+	for _, name := range []string{"ok.txt", "../escape.txt"} {
+		f, _ := w.Create(name)
+		f.Write([]byte(name))
+	}
+	w.Close()
+	if status, _ := testRequest(handler, "PUT /dir?archive=zip", "", archive.String()); status != 400 {
+		t.Errorf("Extracted outside the directory: %d", status)
+	}
+	if files, _ := fs.ReadDir(root); len(files) != 0 {
+		t.Errorf("Extracted %d files from a refused archive", len(files))
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Archive format by file name: zip, tar or tar.gz, or "" for anything else
+func archiveFormat(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	}
+	return ""
+}
+
+// Whether rootPath is an archive to serve instead of a directory
+func isArchive(rootPath string) bool {
+	stat, err := os.Stat(rootPath)
+	return err == nil && stat.Mode().IsRegular() && archiveFormat(rootPath) != ""
+}
+
+// Serves the contents of a zip or tar archive read-only, with the archive
+// itself as the root. Zip entries are read from the archive when opened, tar
+// entries are all read into memory up front.
+func newArchiveFileSystem(archivePath string) (*memoryFileSystem, error) {
+	fs := newMemoryFileSystem(archivePath)
+	fs.readOnly = true
+	if archiveFormat(archivePath) == "zip" {
+		reader, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range reader.File {
+			f := f
+			node := &memoryNode{mode: f.Mode(), modTime: f.Modified, size: int64(f.UncompressedSize64)}
+			node.open = func() (io.ReadCloser, error) {
+				return f.Open()
+			}
+			fs.addArchiveEntry(f.Name, node)
+		}
+		return fs, nil
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if archiveFormat(archivePath) == "tar.gz" {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		r = gz
+	}
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return fs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		info := header.FileInfo()
+		node := &memoryNode{mode: info.Mode(), modTime: header.ModTime, size: header.Size}
+		if info.Mode().IsRegular() {
+			if node.data, err = ioutil.ReadAll(reader); err != nil {
+				return nil, err
+			}
+		}
+		fs.addArchiveEntry(header.Name, node)
+	}
+}
+
+// Adds a file or directory from an archive, with any missing parent
+// directories. Entries are kept inside the root whatever their name says,
+// anything but regular files and directories is left out.
+func (fs *memoryFileSystem) addArchiveEntry(name string, node *memoryNode) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" || !(node.mode.IsDir() || node.mode.IsRegular()) {
+		return
+	}
+	node.modTime = node.modTime.Round(0)
+	if node.modTime.IsZero() {
+		node.modTime = time.Now().Round(0)
+	}
+	dir := fs.root
+	parts := strings.Split(name, "/")
+	for _, part := range parts[:len(parts)-1] {
+		child := dir.children[part]
+		if child == nil {
+			child = newMemoryDir(node.modTime)
+			dir.children[part] = child
+		}
+		if child.children == nil {
+			return
+		}
+		dir = child
+	}
+	last := parts[len(parts)-1]
+	if existing := dir.children[last]; existing != nil && existing.children != nil {
+		if node.mode.IsDir() {
+			existing.mode = node.mode
+			existing.modTime = node.modTime
+		}
+		return
+	}
+	if node.mode.IsDir() {
+		node.children = make(map[string]*memoryNode)
+		node.open = nil
+		node.size = 0
+	}
+	dir.children[last] = node
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+type BatchStatEntry struct {
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	*DirectoryEntry
+}
+
+// Resolves a path of a batch request, relative to the path posted to
+func (self *RootedRPCHandler) resolveBatchPath(req *rpcRequest, p string) (string, os.FileInfo, HttpError) {
+	absPath, httpErr := self.resolvePath(path.Join(req.path, p))
+	if httpErr != nil {
+		return "", nil, httpErr
+	}
+	self.waitForLock(self.relativePath(absPath))
+	stat, err := self.fs.Stat(absPath)
+	if err != nil {
+		return "", nil, fileError(err, "Could not read file")
+	}
+	return absPath, stat, nil
+}
+
+// Stats all path values at once, returning a JSON list with a status per path
+func (self *RootedRPCHandler) handleBatchStat(req *rpcRequest, queryValues url.Values, responseChannel chan []byte) HttpError {
+	entries := make([]BatchStatEntry, 0, len(queryValues["path"]))
+	for _, p := range queryValues["path"] {
+		entry := BatchStatEntry{Path: p, Status: http.StatusOK}
+		absPath, stat, httpErr := self.resolveBatchPath(req, p)
+		if httpErr != nil {
+			entry.Status = httpErr.StatusCode()
+		} else {
+			dirEntry := self.newDirectoryEntry(filepath.Dir(absPath), stat)
+			entry.DirectoryEntry = &dirEntry
+		}
+		entries = append(entries, entry)
+	}
+	responseChannel <- statusCodeBuffer(200)
+	responseChannel <- headerBuffer(map[string]string{"Content-Type": "application/json"})
+	json.NewEncoder(&channelWriter{responseChannel}).Encode(entries)
+	return nil
+}
+
+// Reads all path values at once, returning a multipart/mixed response with a
+// part per path, in order. Each part has X-Path and X-Status headers, and for
+// files that could be read an ETag and the contents.
+func (self *RootedRPCHandler) handleBatchRead(req *rpcRequest, queryValues url.Values, responseChannel chan []byte) HttpError {
+	writer := multipart.NewWriter(&channelWriter{responseChannel})
+	responseChannel <- statusCodeBuffer(200)
+	responseChannel <- headerBuffer(map[string]string{
+		"Content-Type": "multipart/mixed; boundary=" + writer.Boundary(),
+	})
+	for _, p := range queryValues["path"] {
+		header := textproto.MIMEHeader{}
+		header.Set("X-Path", p)
+		absPath, stat, httpErr := self.resolveBatchPath(req, p)
+		var f io.ReadCloser
+		if httpErr == nil && stat.IsDir() {
+			httpErr = NewHttpError(http.StatusConflict, "Is a directory")
+		}
+		if httpErr == nil {
+			var err error
+			if f, err = self.fs.Open(absPath); err != nil {
+				httpErr = fileError(err, "Could not open file")
+			}
+		}
+		if httpErr != nil {
+			header.Set("X-Status", strconv.Itoa(httpErr.StatusCode()))
+			header.Set("Content-Type", "text/plain")
+			part, _ := writer.CreatePart(header)
+			part.Write([]byte(httpErr.Error()))
+			continue
+		}
+		mimeType := mime.TypeByExtension(filepath.Ext(absPath))
+		if mimeType == "" {
+			mimeType = "application/octet-stream"
+		}
+		header.Set("X-Status", "200")
+		header.Set("Content-Type", mimeType)
+		header.Set("ETag", stat.ModTime().String())
+		part, _ := writer.CreatePart(header)
+		io.Copy(part, f)
+		f.Close()
+	}
+	writer.Close()
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBatchStat(t *testing.T) {
+	root := filepath.FromSlash("/project")
+	fs := newMemoryFileSystem(root)
+	fs.WriteFile(filepath.Join(root, "src/a.txt"), strings.NewReader("hello\n"))
+	fs.WriteFile(filepath.Join(root, "src/.env"), strings.NewReader("secret"))
+	fs.Mkdir(filepath.Join(root, "src/lib"), false)
+	handler := NewRootedRPCHandler(root, ClientOptions{FileSystem: fs, Exclude: []string{".env"}})
+
+	status, body := testRequest(handler, "POST /src", "", "action=batch-stat&path=a.txt&path=lib&path=missing&path=.env")
+	if status != 200 {
+		t.Fatalf("batch-stat failed with %d", status)
+	}
+	var entries []BatchStatEntry
+	if err := json.Unmarshal([]byte(body), &entries); err != nil || len(entries) != 4 {
+		t.Fatalf("Unexpected batch-stat: %s", body)
+	}
+	if entries[0].Path != "a.txt" || entries[0].Status != 200 || entries[0].DirectoryEntry == nil || entries[0].Type != "file" || entries[0].Size != 6 {
+		t.Errorf("Unexpected file entry: %s", body)
+	}
+	if entries[1].Status != 200 || entries[1].DirectoryEntry == nil || entries[1].Type != "directory" {
+		t.Errorf("Unexpected directory entry: %s", body)
+	}
+	if entries[2].Status != 404 || entries[3].Status != 404 || entries[3].DirectoryEntry != nil {
+		t.Errorf("Missing or hidden path found: %s", body)
+	}
+}
+
+func TestBatchRead(t *testing.T) {
+	root := filepath.FromSlash("/project")
+	fs := newMemoryFileSystem(root)
+	fs.WriteFile(filepath.Join(root, "src/a.txt"), strings.NewReader("hello\n"))
+	fs.WriteFile(filepath.Join(root, "src/.env"), strings.NewReader("secret"))
+	fs.Mkdir(filepath.Join(root, "src/lib"), false)
+	handler := NewRootedRPCHandler(root, ClientOptions{FileSystem: fs, Exclude: []string{".env"}})
+
+	status, headers, body := testRequestHeaders(handler, "POST /src", "", "action=batch-read&path=a.txt&path=lib&path=missing&path=.env")
+	if status != 200 {
+		t.Fatalf("batch-read failed with %d", status)
+	}
+	_, params, err := mime.ParseMediaType(strings.TrimPrefix(headers, "Content-Type: "))
+	if err != nil {
+		t.Fatalf("Unexpected headers %q: %s", headers, err)
+	}
+	reader := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	expected := []struct {
+		path    string
+		status  string
+		content string
+	}{
+		{"a.txt", "200", "hello\n"},
+		{"lib", "409", ""},
+		{"missing", "404", ""},
+		{".env", "404", ""},
+	}
+	for _, e := range expected {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("Part for %s missing: %s", e.path, err)
+		}
+		content, _ := ioutil.ReadAll(part)
+		if part.Header.Get("X-Path") != e.path || part.Header.Get("X-Status") != e.status {
+			t.Errorf("Unexpected part for %s: %v", e.path, part.Header)
+		}
+		if e.status == "200" && (string(content) != e.content || part.Header.Get("ETag") == "") {
+			t.Errorf("Unexpected contents of %s: %q %v", e.path, content, part.Header)
+		}
+		if e.status != "200" && strings.Contains(string(content), "secret") {
+			t.Errorf("Hidden contents sent for %s", e.path)
+		}
+	}
+	if _, err := reader.NextPart(); err == nil {
+		t.Errorf("More parts than paths")
+	}
+}
@@ -10,7 +10,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"math/rand"
 	"mime"
 	"net/http"
 	"net/url"
@@ -18,7 +18,9 @@ import (
 	"os/signal"
 	"syscall"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -66,54 +68,410 @@ func safePath(rootPath string, path string) (string, error) {
 	if err != nil {
 		return "", NewHttpError(500, err.Error())
 	}
-	if !strings.HasPrefix(absPath, rootPath) {
+	rootPrefix := strings.TrimSuffix(rootPath, string(filepath.Separator)) + string(filepath.Separator)
+	if absPath != rootPath && !strings.HasPrefix(absPath, rootPrefix) {
 		return "", NewHandlingError("Hacking attempt")
 	}
 	return absPath, nil
 }
 
+// Slash separated path of absPath relative to dirPath
+func relativeTo(dirPath string, absPath string) string {
+	relPath, err := filepath.Rel(dirPath, absPath)
+	if err != nil {
+		return absPath
+	}
+	return filepath.ToSlash(relPath)
+}
+
 var writeLock = make(map[string]chan bool)
+var writeLockMutex sync.Mutex
 
 type RootedRPCHandler struct {
         rootPath string
+        fs       FileSystem
+        local    bool
+        readOnly bool
+        rules    *PathRules
+        walkExcludes []string
+        trash    bool
+        trashRetention time.Duration
+        historyStore string
+        historyVersions int
+        uploadExpiry time.Duration
+        execAllow map[string]bool
+        terminal bool
+        forwardPorts map[int]bool
+        languageServers map[string]*LanguageServerConfig
 }
 
-func (self *RootedRPCHandler) handleRequest(requestChannel chan []byte, responseChannel chan []byte, closeChannel chan bool) {
-	commandBuffer, ok := <-requestChannel
-	if !ok {
-		return
+func NewRootedRPCHandler(rootPath string, options ClientOptions) *RootedRPCHandler {
+	include := options.Include
+	exclude := options.Exclude
+	readOnly := options.ReadOnly
+	fs := options.FileSystem
+	if fs == nil {
+		fs = osFileSystem{}
+		if options.Rev != "" {
+			gitFs, err := newGitFileSystem(rootPath, options.Rev)
+			if err != nil {
+				fmt.Println("Could not read revision", options.Rev, err)
+				os.Exit(4)
+			}
+			fs = gitFs
+			readOnly = true
+		} else if isArchive(rootPath) {
+			archiveFs, err := newArchiveFileSystem(rootPath)
+			if err != nil {
+				fmt.Println("Could not read archive", rootPath, err)
+				os.Exit(4)
+			}
+			fs = archiveFs
+			readOnly = true
+		}
+	}
+	// Trash, history, uploads and processes need the files on the local disk
+	_, local := fs.(osFileSystem)
+	trash := options.Trash && local
+	historyVersions := options.HistoryVersions
+	if !local {
+		historyVersions = 0
+	}
+	projectConfig := ParseProjectConfig(fs, rootPath)
+	include = append(include, projectConfig.Client.Include...)
+	exclude = append(exclude, projectConfig.Client.Exclude...)
+	var rules *PathRules
+	if len(include) > 0 || len(exclude) > 0 {
+		rules = NewPathRules(include, exclude)
+	}
+	walkExcludes := options.FilelistExclude
+	if walkExcludes == nil {
+		walkExcludes = defaultWalkExcludes
+	}
+	execAllow := make(map[string]bool)
+	for _, command := range options.ExecAllow {
+		execAllow[command] = true
+	}
+	forwardPorts := make(map[int]bool)
+	for _, port := range options.Forward {
+		forwardPorts[port] = true
+	}
+	return &RootedRPCHandler{
+		rootPath: rootPath,
+		fs:       fs,
+		local:    local,
+		readOnly: readOnly,
+		rules:    rules,
+		walkExcludes: walkExcludes,
+		trash:    trash,
+		trashRetention: options.TrashRetention,
+		historyStore: historyStore(rootPath, options.HistoryDir),
+		historyVersions: historyVersions,
+		uploadExpiry: options.UploadExpiry,
+		execAllow: execAllow,
+		terminal: options.Terminal,
+		forwardPorts: forwardPorts,
+		languageServers: options.LanguageServers,
+	}
+}
+
+// Slash separated path of absPath relative to the root
+func (self *RootedRPCHandler) relativePath(absPath string) string {
+	return relativeTo(self.rootPath, absPath)
+}
+
+// Directories zedrem keeps its own data in, never exposed
+var internalDirs = map[string]bool{
+	TRASH_DIR:  true,
+	UPLOAD_DIR: true,
+}
+
+// Whether path is in git's metadata, which can't be written: git runs
+// commands its config names, and the git actions run git
+func isGitPath(path string) bool {
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if strings.EqualFold(part, ".git") {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *RootedRPCHandler) isHidden(absPath string, isDir bool) bool {
+	relPath := self.relativePath(absPath)
+	if internalDirs[strings.SplitN(relPath, "/", 2)[0]] {
+		return true
+	}
+	return self.rules.IsHidden(relPath, isDir)
+}
+
+// Whether absPath is a symlink, or below one, to a path that is outside the
+// root or hidden. A path that doesn't exist yet is taken to be where its
+// nearest existing parent resolves to.
+func (self *RootedRPCHandler) hidesRealPath(absPath string) bool {
+	existing, rest := absPath, ""
+	realPath, err := self.fs.EvalSymlinks(existing)
+	for err != nil && existing != self.rootPath {
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+		realPath, err = self.fs.EvalSymlinks(existing)
+	}
+	if err != nil {
+		return false
+	}
+	realPath = filepath.Join(realPath, rest)
+	realRoot, err := self.fs.EvalSymlinks(self.rootPath)
+	if err != nil {
+		realRoot = self.rootPath
 	}
-	command := string(commandBuffer)
-	// headers
-	_, ok = <-requestChannel
+	relPath, err := filepath.Rel(realRoot, realPath)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return true
+	}
+	rootedPath := filepath.Join(self.rootPath, relPath)
+	if rootedPath == absPath {
+		return false
+	}
+	stat, err := self.fs.Stat(realPath)
+	return self.isHidden(rootedPath, err == nil && stat.IsDir())
+}
+
+// Like safePath, but also treats paths hidden by the path rules as non-existent,
+// whether by their own name or by where symlinks lead
+func (self *RootedRPCHandler) resolvePath(path string) (string, HttpError) {
+	absPath, err := safePath(self.rootPath, path)
+	if err != nil {
+		return "", err.(HttpError)
+	}
+	isDir := false
+	if self.rules != nil {
+		stat, err := self.fs.Stat(absPath)
+		isDir = err == nil && stat.IsDir()
+	}
+	if self.isHidden(absPath, isDir) || self.hidesRealPath(absPath) {
+		return "", NewHttpError(http.StatusNotFound, "Not found")
+	}
+	return absPath, nil
+}
+
+// POST actions on paths that don't need to exist yet
+var newPathActions = map[string]bool{
+	"mkdir":         true,
+	"trash-list":    true,
+	"trash-restore": true,
+	"trash-purge":   true,
+	"history-list":  true,
+	"history-restore": true,
+	"history-diff":  true,
+	"git-show":      true,
+	"git-blame":     true,
+	"git-log":       true,
+	"upload-create": true,
+	"upload-status": true,
+	"upload-commit": true,
+	"upload-cancel": true,
+}
+
+// Methods refused in read-only mode
+var writeMethods = map[string]bool{
+	"PUT":    true,
+	"DELETE": true,
+	"MOVE":   true,
+	"COPY":   true,
+	"MKCOL":  true,
+	"PATCH":  true,
+	"TERMINAL": true,
+	// Language servers run build scripts and write caches into the root
+	"LSP":    true,
+}
+
+// POST actions that don't modify anything and are allowed in read-only mode
+var readOnlyActions = map[string]bool{
+	"filelist": true,
+	"search":   true,
+	"trash-list": true,
+	"history-list": true,
+	"history-diff": true,
+	"upload-status": true,
+	"git-status": true,
+	"git-diff":   true,
+	"git-blame":  true,
+	"git-log":    true,
+	"git-show":   true,
+	"batch-stat": true,
+	"batch-read": true,
+	"version":  true,
+	"watch":    true,
+}
+
+// POST actions that only go through the file system, and so are available
+// when not serving the local disk
+var fileSystemActions = map[string]bool{
+	"filelist":   true,
+	"search":     true,
+	"watch":      true,
+	"mkdir":      true,
+	"batch-stat": true,
+	"batch-read": true,
+	"version":    true,
+}
+
+// Methods that need the files on the local disk
+var localMethods = map[string]bool{
+	"TERMINAL": true,
+	"LSP":      true,
+}
+
+func (self *RootedRPCHandler) handleRequest(requestChannel chan []byte, responseChannel chan []byte, closeChannel chan bool) {
+	req, ok := readRequest(requestChannel)
 	if !ok {
+		closeChannel <- true
 		return
 	}
+	self.serveRequest(req, requestChannel, responseChannel)
+	responseChannel <- DELIMITERBUFFER
+	closeChannel <- true
+}
 
+// Handles a parsed request, the caller ends the response
+func (self *RootedRPCHandler) serveRequest(req *rpcRequest, requestChannel chan []byte, responseChannel chan []byte) {
 	var err HttpError
-	commandParts := strings.Split(command, " ")
-	method := commandParts[0]
-	path := strings.Join(commandParts[1:], "/")
-	if strings.HasPrefix(path, "/") {
-		path = path[1:]
-	}
-	switch method {
-	case "GET":
-		err = self.handleGet(path, requestChannel, responseChannel)
-	case "HEAD":
-		err = self.handleHead(path, requestChannel, responseChannel)
-	case "PUT":
-		err = self.handlePut(path, requestChannel, responseChannel)
-	case "DELETE":
-		err = self.handleDelete(path, requestChannel, responseChannel)
-	case "POST":
-		err = self.handlePost(path, requestChannel, responseChannel)
+	method := req.method
+	switch {
+	case self.readOnly && writeMethods[method]:
+		dropUntilDelimiter(requestChannel)
+		err = NewHttpError(http.StatusForbidden, "Read-only mode")
+	case writeMethods[method] && (isGitPath(req.path) || isGitPath(req.header.Get("Destination"))):
+		dropUntilDelimiter(requestChannel)
+		err = NewHttpError(http.StatusForbidden, "Git metadata can't be written")
+	case !self.local && (localMethods[method] || req.query.Get("upload") != ""):
+		dropUntilDelimiter(requestChannel)
+		err = NewHttpError(http.StatusNotImplemented, "Only available when serving the local disk")
+	case method == "GET":
+		err = self.handleGet(req, requestChannel, responseChannel)
+	case method == "HEAD":
+		err = self.handleHead(req, requestChannel, responseChannel)
+	case method == "PUT":
+		err = self.handlePut(req, requestChannel, responseChannel)
+	case method == "DELETE":
+		err = self.handleDelete(req, requestChannel, responseChannel)
+	case method == "POST":
+		err = self.handlePost(req, requestChannel, responseChannel)
+	case method == "MOVE":
+		err = self.handleMove(req, requestChannel, responseChannel)
+	case method == "COPY":
+		err = self.handleCopy(req, requestChannel, responseChannel)
+	case method == "PATCH":
+		err = self.handlePatch(req, requestChannel, responseChannel)
+	case method == "TERMINAL":
+		err = self.handleTerminal(req, requestChannel, responseChannel)
+	case method == "CONNECT":
+		err = self.handleConnect(req, requestChannel, responseChannel)
+	case method == "LSP":
+		err = self.handleLsp(req, requestChannel, responseChannel)
+	case method == "MKCOL":
+		err = self.handleMkcol(req, requestChannel, responseChannel)
+	default:
+		dropUntilDelimiter(requestChannel)
+		err = NewHttpError(http.StatusMethodNotAllowed, "Method not allowed")
 	}
 	if err != nil {
-		sendError(responseChannel, err, commandParts[0] != "HEAD")
+		sendError(responseChannel, err, method != "HEAD")
 	}
-	responseChannel <- DELIMITERBUFFER
-	closeChannel <- true
+}
+
+type rpcRequest struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+}
+
+// Reads the request line and headers of a request, false when it was
+// cancelled before that
+func readRequest(requestChannel chan []byte) (*rpcRequest, bool) {
+	commandBuffer, ok := <-requestChannel
+	if !ok || IsCancel(commandBuffer) {
+		return nil, false
+	}
+	headersBuffer, ok := <-requestChannel
+	if !ok || IsCancel(headersBuffer) {
+		return nil, false
+	}
+	return parseRequest(string(commandBuffer), headersBuffer), true
+}
+
+// Parses a request line of the form "METHOD /path?query" and the headers
+// as forwarded by the server
+func parseRequest(command string, headersBuffer []byte) *rpcRequest {
+	req := &rpcRequest{
+		header: make(http.Header),
+	}
+	commandParts := strings.SplitN(command, " ", 2)
+	req.method = commandParts[0]
+	if len(commandParts) > 1 {
+		req.path = commandParts[1]
+	}
+	if i := strings.Index(req.path, "?"); i != -1 {
+		req.query, _ = url.ParseQuery(req.path[i+1:])
+		req.path = req.path[:i]
+	} else {
+		req.query = make(url.Values)
+	}
+	// The path is escaped, so a ? in a file name doesn't start the query.
+	// Older servers send it unescaped, which mostly unescapes to itself.
+	if path, err := url.PathUnescape(req.path); err == nil {
+		req.path = path
+	}
+	if strings.HasPrefix(req.path, "/") {
+		req.path = req.path[1:]
+	}
+	for _, line := range strings.Split(string(headersBuffer), "\n") {
+		headerParts := strings.SplitN(line, ": ", 2)
+		if len(headerParts) != 2 {
+			continue
+		}
+		value := headerParts[1]
+		// Older servers send all values as a single Go formatted slice
+		if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+			value = value[1 : len(value)-1]
+		}
+		req.header.Add(headerParts[0], value)
+	}
+	return req
+}
+
+// Whether the query parameter is set to a true value, e.g. hidden=true
+func (req *rpcRequest) flag(name string) bool {
+	value := req.query.Get(name)
+	return value == "true" || value == "1"
+}
+
+func (req *rpcRequest) accepts(contentType string) bool {
+	for _, accept := range req.header["Accept"] {
+		if strings.Contains(accept, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// io.Writer that sends everything written to it as response buffers
+type channelWriter struct {
+	responseChannel chan []byte
+}
+
+func (w *channelWriter) Write(p []byte) (int, error) {
+	for written := 0; written < len(p); written += BUFFER_SIZE {
+		end := written + BUFFER_SIZE
+		if end > len(p) {
+			end = len(p)
+		}
+		buffer := make([]byte, end-written)
+		copy(buffer, p[written:end])
+		w.responseChannel <- buffer
+	}
+	return len(p), nil
 }
 
 func sendError(responseChannel chan []byte, err HttpError, withMessageInBody bool) {
@@ -127,18 +485,35 @@ func sendError(responseChannel chan []byte, err HttpError, withMessageInBody boo
 	}
 }
 
+// Drops the rest of the body, which also ends when the request is cancelled
 func dropUntilDelimiter(requestChannel chan []byte) {
 	for {
 		buffer, ok := <-requestChannel
 		if !ok {
 			break
 		}
-		if IsDelimiter(buffer) {
+		if IsDelimiter(buffer) || IsCancel(buffer) {
 			break
 		}
 	}
 }
 
+// Returns a channel that is closed once the server cancels the request or the
+// connection is lost. For long running handlers that have read the whole body.
+func cancelNotifier(requestChannel chan []byte) chan bool {
+	cancelled := make(chan bool)
+	go func() {
+		for {
+			buffer, ok := <-requestChannel
+			if !ok || IsCancel(buffer) {
+				close(cancelled)
+				return
+			}
+		}
+	}()
+	return cancelled
+}
+
 func headerBuffer(headers map[string]string) []byte {
 	var headerBuffer bytes.Buffer
 	for h, v := range headers {
@@ -152,39 +527,66 @@ func statusCodeBuffer(code int) []byte {
 	return IntToBytes(code)
 }
 
-func waitForLock(path string) {
-	if writeLock[path] != nil {
-		<-writeLock[path]
+// Key of path, relative to the root, in writeLock. Keyed by the absolute path
+// so that equal paths in different roots don't share a lock.
+func (self *RootedRPCHandler) lockKey(path string) string {
+	return filepath.Join(self.rootPath, filepath.FromSlash(path))
+}
+
+func (self *RootedRPCHandler) waitForLock(path string) {
+	writeLockMutex.Lock()
+	lock := writeLock[self.lockKey(path)]
+	writeLockMutex.Unlock()
+	if lock != nil {
+		<-lock
 	}
 }
 
-func (self *RootedRPCHandler) handleGet(path string, requestChannel chan []byte, responseChannel chan []byte) HttpError {
-	waitForLock(path)
+// Marks path as being written to, returns false if a write is already going on
+func (self *RootedRPCHandler) acquireWriteLock(path string) bool {
+	key := self.lockKey(path)
+	writeLockMutex.Lock()
+	defer writeLockMutex.Unlock()
+	if writeLock[key] != nil {
+		return false
+	}
+	writeLock[key] = make(chan bool)
+	return true
+}
+
+func (self *RootedRPCHandler) releaseWriteLock(path string) {
+	key := self.lockKey(path)
+	writeLockMutex.Lock()
+	defer writeLockMutex.Unlock()
+	close(writeLock[key])
+	delete(writeLock, key)
+}
+
+func (self *RootedRPCHandler) handleGet(req *rpcRequest, requestChannel chan []byte, responseChannel chan []byte) HttpError {
+	path := req.path
+	self.waitForLock(path)
 
 	dropUntilDelimiter(requestChannel)
-	safePath, err := safePath(self.rootPath, path)
-	if err != nil {
-		return err.(HttpError)
+	safePath, httpErr := self.resolvePath(path)
+	if httpErr != nil {
+		return httpErr
 	}
-	stat, err := os.Stat(safePath)
+	stat, err := self.fs.Stat(safePath)
 	if err != nil {
 		return NewHttpError(404, "Not found")
 	}
-	responseChannel <- statusCodeBuffer(200)
 	if stat.IsDir() {
-		responseChannel <- headerBuffer(map[string]string{"Content-Type": "text/plain"})
-		files, _ := ioutil.ReadDir(safePath)
-		for _, f := range files {
-			if f.Name()[0] == '.' {
-				continue
-			}
-			if f.IsDir() {
-				responseChannel <- []byte(fmt.Sprintf("%s/\n", f.Name()))
-			} else {
-				responseChannel <- []byte(fmt.Sprintf("%s\n", f.Name()))
-			}
+		if req.query.Get("archive") != "" {
+			return self.sendArchive(req, safePath, responseChannel)
 		}
+		return self.listDirectory(req, safePath, responseChannel)
 	} else { // File
+		f, err := self.fs.Open(safePath)
+		if err != nil {
+			return NewHttpError(500, "Could not open file")
+		}
+		defer f.Close()
+		responseChannel <- statusCodeBuffer(200)
 		mimeType := mime.TypeByExtension(filepath.Ext(safePath))
 		if mimeType == "" {
 			mimeType = "application/octet-stream"
@@ -193,11 +595,6 @@ func (self *RootedRPCHandler) handleGet(path string, requestChannel chan []byte,
 			"Content-Type": mimeType,
 			"ETag":         stat.ModTime().String(),
 		})
-		f, err := os.Open(safePath)
-		if err != nil {
-			return NewHttpError(500, "Could not open file")
-		}
-		defer f.Close()
 		for {
 			buffer := make([]byte, BUFFER_SIZE)
 			n, _ := f.Read(buffer)
@@ -210,15 +607,98 @@ func (self *RootedRPCHandler) handleGet(path string, requestChannel chan []byte,
 	return nil
 }
 
-func (self *RootedRPCHandler) handleHead(path string, requestChannel chan []byte, responseChannel chan []byte) HttpError {
-	waitForLock(path)
+type DirectoryEntry struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mtime"`
+	ETag    string    `json:"etag"`
+	Target  string    `json:"target,omitempty"`
+}
 
-	safePath, err := safePath(self.rootPath, path)
-	dropUntilDelimiter(requestChannel)
+func (self *RootedRPCHandler) newDirectoryEntry(dirPath string, f os.FileInfo) DirectoryEntry {
+	entry := DirectoryEntry{
+		Name:    f.Name(),
+		Type:    "file",
+		Size:    f.Size(),
+		Mode:    fmt.Sprintf("%04o", f.Mode().Perm()),
+		ModTime: f.ModTime(),
+		ETag:    f.ModTime().String(),
+	}
+	if f.IsDir() {
+		entry.Type = "directory"
+	} else if f.Mode()&os.ModeSymlink != 0 {
+		entry.Type = "symlink"
+		entry.Target, _ = self.fs.Readlink(filepath.Join(dirPath, f.Name()))
+	}
+	return entry
+}
+
+// Lists a directory either as plain "name" and "name/" lines, or as a JSON
+// array of DirectoryEntry when the request accepts application/json. Dot
+// files are only included with ?hidden=true.
+func (self *RootedRPCHandler) listDirectory(req *rpcRequest, dirPath string, responseChannel chan []byte) HttpError {
+	files, err := self.fs.ReadDir(dirPath)
 	if err != nil {
-		return err.(HttpError)
+		return NewHttpError(http.StatusInternalServerError, "Could not read directory")
 	}
-	stat, err := os.Stat(safePath)
+	includeHidden := req.flag("hidden")
+	visibleFiles := make([]os.FileInfo, 0, len(files))
+	for _, f := range files {
+		if f.Name()[0] == '.' && !includeHidden {
+			continue
+		}
+		if self.isHidden(filepath.Join(dirPath, f.Name()), f.IsDir()) {
+			continue
+		}
+		visibleFiles = append(visibleFiles, f)
+	}
+
+	responseChannel <- statusCodeBuffer(200)
+	if req.accepts("application/json") {
+		responseChannel <- headerBuffer(map[string]string{"Content-Type": "application/json"})
+		entries := make([]DirectoryEntry, len(visibleFiles))
+		for i, f := range visibleFiles {
+			entries[i] = self.newDirectoryEntry(dirPath, f)
+		}
+		json.NewEncoder(&channelWriter{responseChannel}).Encode(entries)
+		return nil
+	}
+	responseChannel <- headerBuffer(map[string]string{"Content-Type": "text/plain"})
+	for _, f := range visibleFiles {
+		if f.IsDir() {
+			responseChannel <- []byte(fmt.Sprintf("%s/\n", f.Name()))
+		} else {
+			responseChannel <- []byte(fmt.Sprintf("%s\n", f.Name()))
+		}
+	}
+	return nil
+}
+
+func (self *RootedRPCHandler) handleHead(req *rpcRequest, requestChannel chan []byte, responseChannel chan []byte) HttpError {
+	path := req.path
+	if id := req.query.Get("upload"); id != "" {
+		dropUntilDelimiter(requestChannel)
+		_, stat, httpErr := self.readUpload(id)
+		if httpErr != nil {
+			return httpErr
+		}
+		responseChannel <- statusCodeBuffer(200)
+		responseChannel <- headerBuffer(map[string]string{
+			"Content-Length":  "0",
+			"X-Upload-Offset": strconv.FormatInt(stat.Size(), 10),
+		})
+		return nil
+	}
+	self.waitForLock(path)
+
+	safePath, httpErr := self.resolvePath(path)
+	dropUntilDelimiter(requestChannel)
+	if httpErr != nil {
+		return httpErr
+	}
+	stat, err := self.fs.Stat(safePath)
 	if err != nil {
 		return NewHttpError(404, "Not found")
 	}
@@ -227,91 +707,46 @@ func (self *RootedRPCHandler) handleHead(path string, requestChannel chan []byte
 	if stat.IsDir() {
 		fileType = "directory"
 	}
-	responseChannel <- headerBuffer(map[string]string{
+	headers := map[string]string{
 		"ETag":           stat.ModTime().String(),
 		"Content-Length": "0",
 		"X-Type": fileType,
-	})
+	}
+	if self.readOnly {
+		headers["X-ReadOnly"] = "true"
+	}
+	responseChannel <- headerBuffer(headers)
 	return nil
 }
 
-func (self *RootedRPCHandler) handlePut(path string, requestChannel chan []byte, responseChannel chan []byte) HttpError {
-	if writeLock[path] != nil {
+func (self *RootedRPCHandler) handlePut(req *rpcRequest, requestChannel chan []byte, responseChannel chan []byte) HttpError {
+	if req.query.Get("upload") != "" {
+		return self.handleUploadChunk(req, requestChannel, responseChannel)
+	}
+	if req.query.Get("archive") != "" {
+		return self.handleExtract(req, requestChannel, responseChannel)
+	}
+	path := req.path
+	if !self.acquireWriteLock(path) {
 		// Already writing
 		dropUntilDelimiter(requestChannel)
 		return NewHttpError(500, "Write already going on")
 	}
+	defer self.releaseWriteLock(path)
 
-	writeLock[path] = make(chan bool)
-
-	defer func() {
-		close(writeLock[path])
-		writeLock[path] = nil
-	}()
-
-	safePath, err := safePath(self.rootPath, path)
-	if err != nil {
+	safePath, httpErr := self.resolvePath(path)
+	if httpErr != nil {
 		dropUntilDelimiter(requestChannel)
-		return err.(HttpError)
+		return httpErr
 	}
-	dir := filepath.Dir(safePath)
-	os.MkdirAll(dir, 0777)
-
-	// To avoid corrupted files, we'll write to a temp path first
-	tempPath := dir + "/.zedtmp." + uuid.New()
-	f, err := os.Create(tempPath)
-	if err != nil {
-		dropUntilDelimiter(requestChannel)
-		return NewHttpError(500, fmt.Sprintf("Could not create file: %s", tempPath))
-	}
-	for {
-		buffer := <-requestChannel
-		if IsDelimiter(buffer) {
-			break
-		}
-		_, err := f.Write(buffer)
-		if err != nil {
-			dropUntilDelimiter(requestChannel)
-			return NewHttpError(500, "Could not write to file")
-		}
+	body := &channelReader{requestChannel: requestChannel}
+	httpErr = self.writeFile(safePath, body)
+	body.drain()
+	if httpErr != nil {
+		return httpErr
 	}
-	f.Sync()
-	f.Close()
 
-        // Get existing file permissions
-	var mode os.FileMode = 0666
-	stat, err := os.Stat(safePath)
-	if err == nil {
-		mode = stat.Mode()
-	}
-	// And then copy it over again
-
-        f, err = os.Open(tempPath)
-        if err != nil {
-                return NewHttpError(500, fmt.Sprintf("Could not read temporary file for copy: %s", tempPath))
-        }
-	fout, err := os.OpenFile(safePath, os.O_WRONLY | os.O_TRUNC | os.O_CREATE, mode)
-        if err != nil {
-                return NewHttpError(500, fmt.Sprintf("Could not open target file for copy: %s", safePath))
-        }
-
-        io.Copy(fout, f)
-        f.Close()
-        fout.Close()
-
-        os.Remove(tempPath)
-
-//         if err := os.Chmod(tempPath, mode); err != nil {
-//                 return NewHttpError(500, "unable to chmod tmpfile: " + err.Error())
-//         }
-
-//         // Rename the temp file to a the real file. This is done "atomically",
-//         // so that even if something goes weird, we'll either have an old or new version.
-//         if err := os.Rename(tempPath, safePath); err != nil {
-//                 return NewHttpError(500, "Unable to replace old version: " + err.Error())
-//         }
-
-	stat, _ = os.Stat(safePath)
+	stat, _ := self.fs.Stat(safePath)
 	responseChannel <- statusCodeBuffer(200)
 	responseChannel <- headerBuffer(map[string]string{
 		"Content-Type": "text/plain",
@@ -321,21 +756,101 @@ func (self *RootedRPCHandler) handlePut(path string, requestChannel chan []byte,
 	return nil
 }
 
-func (self *RootedRPCHandler) handleDelete(path string, requestChannel chan []byte, responseChannel chan []byte) HttpError {
-	waitForLock(path)
+func newTempPath(absPath string) string {
+	return filepath.Dir(absPath) + "/.zedtmp." + uuid.New()
+}
 
-	safePath, err := safePath(self.rootPath, path)
+// Replaces absPath (or the file it links to) with a fully written temporary
+// file, keeping the permissions of the existing file. The temporary file is
+// renamed over it so readers never see a partial file, or copied if that's
+// not possible.
+func replaceFile(tempPath string, absPath string) error {
+	if realPath, err := filepath.EvalSymlinks(absPath); err == nil {
+		absPath = realPath
+	}
+	if stat, err := os.Stat(absPath); err == nil {
+		os.Chmod(tempPath, stat.Mode().Perm())
+	}
+	if err := os.Rename(tempPath, absPath); err == nil {
+		return nil
+	}
+	f, err := os.Open(tempPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fout, err := os.OpenFile(absPath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
 	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fout, f); err != nil {
+		fout.Close()
+		return err
+	}
+	return fout.Close()
+}
+
+// Replaces safePath with the contents of a fully written temporary file on
+// the local disk, keeping a copy of its previous version in the history. The
+// temporary file is left to the caller when that fails.
+func (self *RootedRPCHandler) commitTempFile(tempPath string, safePath string) HttpError {
+	if err := self.saveVersion(safePath); err != nil {
+		fmt.Println("Could not save previous version of", safePath, err)
+	}
+	if err := replaceFile(tempPath, safePath); err != nil {
+		return fileError(err, "Could not replace file")
+	}
+	os.Remove(tempPath)
+	return nil
+}
+
+// Writes a file through the file system, keeping a copy of its previous
+// version in the history
+func (self *RootedRPCHandler) writeFile(absPath string, r io.Reader) HttpError {
+	if err := self.saveVersion(absPath); err != nil {
+		fmt.Println("Could not save previous version of", absPath, err)
+	}
+	if err := self.fs.WriteFile(absPath, r); err != nil {
+		return fileError(err, "Could not write file")
+	}
+	return nil
+}
+
+func (self *RootedRPCHandler) handleDelete(req *rpcRequest, requestChannel chan []byte, responseChannel chan []byte) HttpError {
+	path := req.path
+	self.waitForLock(path)
+
+	safePath, httpErr := self.resolvePath(path)
+	if httpErr != nil {
 	dropUntilDelimiter(requestChannel)
-		return err.(HttpError)
+		return httpErr
+	}
+	if safePath == self.rootPath {
+		return NewHttpError(http.StatusForbidden, "Cannot delete the root")
 	}
-	_, err = os.Stat(safePath)
+	stat, err := self.fs.Lstat(safePath)
 	if err != nil {
-		return NewHttpError(404, "Not found")
+		return fileError(err, "Could not delete")
+	}
+	// Non-empty directories are only deleted with explicit confirmation
+	if stat.IsDir() && !req.flag("recursive") {
+		if files, _ := self.fs.ReadDir(safePath); len(files) > 0 {
+			return NewHttpError(http.StatusConflict, "Directory not empty, pass recursive=true to delete it")
+		}
+	}
+	if self.trash && !req.flag("permanent") {
+		err = self.moveToTrash(safePath, safePath, stat.IsDir())
+	} else if stat.IsDir() && self.containsHidden(safePath) {
+		// Paths hidden by the rules stay, with the directories they are in
+		err = self.removeVisible(safePath)
+	} else {
+		err = self.fs.Remove(safePath, stat.IsDir())
 	}
-	err = os.Remove(safePath)
 	if err != nil {
-		return NewHttpError(500, "Could not delete")
+		if stat.IsDir() && isNotEmpty(err) {
+			return NewHttpError(http.StatusConflict, "Directory not empty, pass recursive=true to delete it")
+		}
+		return fileError(err, "Could not delete")
 	}
 	responseChannel <- statusCodeBuffer(200)
 	responseChannel <- headerBuffer(map[string]string{
@@ -346,53 +861,111 @@ func (self *RootedRPCHandler) handleDelete(path string, requestChannel chan []by
 	return nil
 }
 
-func walkDirectory(responseChannel chan []byte, root string, path string) {
-	files, _ := ioutil.ReadDir(filepath.Join(root, path))
-	for _, f := range files {
-		if f.IsDir() {
-			walkDirectory(responseChannel, root, filepath.Join(path, f.Name()))
-		} else {
-			responseChannel <- []byte(fmt.Sprintf("/%s\n", filepath.Join(path, f.Name())))
-		}
-	}
+// io.Reader for a request body, ending at the delimiter. A body cut off by
+// a cancel or the connection going away ends with io.ErrUnexpectedEOF, so
+// it isn't taken for a whole one.
+type channelReader struct {
+	requestChannel chan []byte
+	pending        []byte
+	done           bool
+	err            error
 }
 
-func readWholeBody(requestChannel chan []byte) []byte {
-	var byteBuffer bytes.Buffer
-	for {
-		buffer := <-requestChannel
-		if IsDelimiter(buffer) {
-			break
+func (r *channelReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, r.err
+		}
+		buffer, ok := <-r.requestChannel
+		r.err = io.EOF
+		if !ok || IsCancel(buffer) {
+			r.err = io.ErrUnexpectedEOF
+		}
+		if !ok || IsCancel(buffer) || IsDelimiter(buffer) {
+			r.done = true
+			return 0, r.err
 		}
-		byteBuffer.Write(buffer)
+		r.pending = buffer
 	}
-	return byteBuffer.Bytes()
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
 }
 
-func (self *RootedRPCHandler) handlePost(path string, requestChannel chan []byte, responseChannel chan []byte) HttpError {
-	safePath, err := safePath(self.rootPath, path)
-	body := string(readWholeBody(requestChannel))
-	if err != nil {
-		return err.(HttpError)
+// Drops whatever wasn't read of the body
+func (r *channelReader) drain() {
+	if !r.done {
+		dropUntilDelimiter(r.requestChannel)
+		r.done = true
 	}
-	_, err = os.Stat(safePath)
+}
+
+// Reads the body, failing when it was cut off, see channelReader
+func readWholeBody(requestChannel chan []byte) ([]byte, HttpError) {
+	body, err := ioutil.ReadAll(&channelReader{requestChannel: requestChannel})
 	if err != nil {
-		return NewHttpError(http.StatusNotFound, "Not found")
+		return nil, NewHttpError(http.StatusBadRequest, "Request body cut off")
 	}
+	return body, nil
+}
 
+func (self *RootedRPCHandler) handlePost(req *rpcRequest, requestChannel chan []byte, responseChannel chan []byte) HttpError {
+	path := req.path
+	safePath, httpErr := self.resolvePath(path)
+	bodyBuffer, bodyErr := readWholeBody(requestChannel)
+	if httpErr != nil {
+		return httpErr
+	}
+	if bodyErr != nil {
+		return bodyErr
+	}
+	body := string(bodyBuffer)
 	queryValues, err := url.ParseQuery(body)
 	if err != nil {
 		return NewHttpError(http.StatusInternalServerError, "Could not parse body as HTTP post")
 	}
 
-	action := queryValues["action"][0]
+	action := queryValues.Get("action")
+	if self.readOnly && !readOnlyActions[action] {
+		return NewHttpError(http.StatusForbidden, "Read-only mode")
+	}
+	if !readOnlyActions[action] && isGitPath(path) {
+		return NewHttpError(http.StatusForbidden, "Git metadata can't be written")
+	}
+	if !self.local && !fileSystemActions[action] {
+		return NewHttpError(http.StatusNotImplemented, "Only available when serving the local disk")
+	}
+	if !newPathActions[action] {
+		if _, err := self.fs.Stat(safePath); err != nil {
+			return NewHttpError(http.StatusNotFound, "Not found")
+		}
+	}
 	switch action {
 	case "filelist":
-		responseChannel <- statusCodeBuffer(200)
-		responseChannel <- headerBuffer(map[string]string{
-			"Content-Type": "text/plain",
-		})
-		walkDirectory(responseChannel, safePath, "")
+		return self.handleFileList(safePath, queryValues, requestChannel, responseChannel)
+	case "search":
+		return self.handleSearch(safePath, queryValues, requestChannel, responseChannel)
+	case "watch":
+		return self.handleWatch(safePath, queryValues, requestChannel, responseChannel)
+	case "mkdir":
+		if httpErr := self.makeDirectory(safePath, queryValues.Get("parents") == "true"); httpErr != nil {
+			return httpErr
+		}
+		sendCreated(responseChannel)
+	case "trash-list", "trash-restore", "trash-purge":
+		return self.handleTrash(action, queryValues, responseChannel)
+	case "history-list", "history-restore", "history-diff":
+		return self.handleHistory(action, req, safePath, queryValues, responseChannel)
+	case "upload-create", "upload-status", "upload-commit", "upload-cancel":
+		return self.handleUpload(action, req, safePath, queryValues, responseChannel)
+	case "git-status", "git-diff", "git-blame", "git-log", "git-show":
+		return self.handleGit(action, safePath, queryValues, responseChannel)
+	case "exec":
+		return self.handleExec(safePath, queryValues, requestChannel, responseChannel)
+	case "batch-stat":
+		return self.handleBatchStat(req, queryValues, responseChannel)
+	case "batch-read":
+		return self.handleBatchRead(req, queryValues, responseChannel)
 	case "version":
 		responseChannel <- statusCodeBuffer(200)
 		responseChannel <- headerBuffer(map[string]string{
@@ -406,23 +979,87 @@ func (self *RootedRPCHandler) handlePost(path string, requestChannel chan []byte
 	return nil
 }
 
-// Side-effect: writes to rootPath
-func ParseClientFlags(args []string) (url string, userKey string, rootPath string) {
+type ClientOptions struct {
+	Url      string
+	UserKey  string
+	RootPath string
+	ReadOnly bool
+	Include  []string
+	Exclude  []string
+	FilelistExclude []string
+	Trash    bool
+	TrashRetention time.Duration
+	HistoryDir string
+	HistoryVersions int
+	UploadExpiry time.Duration
+	ExecAllow []string
+	Terminal bool
+	Forward  []int
+	LanguageServers map[string]*LanguageServerConfig
+	Rev      string
+	Roots    []NamedRoot
+	RootConfigs map[string]*RootConfig
+	Persist  bool
+	// Sent along with the session id, see authenticateHello
+	Secret   string
+	// Serve this instead of the files below RootPath, mostly for tests
+	FileSystem FileSystem
+}
+
+func ParseClientFlags(args []string) (options ClientOptions) {
 	config := ParseConfig()
 
 	flagSet := flag.NewFlagSet("zedrem", flag.ExitOnError)
 	var stats bool
-	flagSet.StringVar(&url, "u", config.Client.Url, "URL to connect to")
-	flagSet.StringVar(&userKey, "key", config.Client.UserKey, "User key to use")
+	flagSet.StringVar(&options.Url, "u", config.Client.Url, "URL to connect to")
+	flagSet.StringVar(&options.UserKey, "key", config.Client.UserKey, "User key to use")
+	flagSet.BoolVar(&options.ReadOnly, "readonly", config.Client.ReadOnly, "Only allow reading files, refuse all writes")
+	flagSet.StringVar(&options.Rev, "rev", "", "Serve the tree of this git revision, read-only, instead of the working tree")
+	flagSet.BoolVar(&options.Trash, "trash", config.Client.Trash, "Move deleted files into a .zedrem-trash directory instead of removing them")
+	flagSet.BoolVar(&options.Persist, "persist", config.Client.Persist, "Keep the session id in ~/.zedrem/sessions, so the URL stays the same across restarts")
+	flagSet.BoolVar(&options.Terminal, "terminal", false, "Allow opening interactive shells in the root from the editor")
+	flagSet.Var((*portList)(&options.Forward), "forward", "Local port to make reachable through the relay, can be repeated")
 	flagSet.BoolVar(&stats, "stats", false, "Whether to print go-routine count and memory usage stats periodically.")
 	flagSet.Parse(args)
 	if stats {
 		go PrintStats()
 	}
-	if flagSet.NArg() == 0 {
-        	rootPath = "."
-	} else {
-		rootPath = args[len(args)-1]
+	roots, err := parseNamedRoots(flagSet.Args())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(4)
+	}
+	options.Roots = roots
+	options.RootConfigs = config.Root
+	if len(roots) == 0 && flagSet.NArg() == 0 {
+        	options.RootPath = "."
+	} else if len(roots) == 0 {
+		options.RootPath = args[len(args)-1]
+	}
+	options.Include = config.Client.Include
+	options.Exclude = config.Client.Exclude
+	options.FilelistExclude = config.Client.FilelistExclude
+	options.HistoryDir = config.Client.HistoryDir
+	options.HistoryVersions = config.Client.HistoryVersions
+	options.TrashRetention = DEFAULT_TRASH_RETENTION
+	if config.Client.TrashRetention != "" {
+		retention, err := time.ParseDuration(config.Client.TrashRetention)
+		if err != nil {
+			fmt.Println("Invalid trashretention in ~/.zedremrc:", err)
+			os.Exit(4)
+		}
+		options.TrashRetention = retention
+	}
+	options.ExecAllow = config.Client.ExecAllow
+	options.LanguageServers = config.Lsp
+	options.UploadExpiry = DEFAULT_UPLOAD_EXPIRY
+	if config.Client.UploadExpiry != "" {
+		expiry, err := time.ParseDuration(config.Client.UploadExpiry)
+		if err != nil {
+			fmt.Println("Invalid uploadexpiry in ~/.zedremrc:", err)
+			os.Exit(4)
+		}
+		options.UploadExpiry = expiry
 	}
 	return
 }
@@ -440,12 +1077,37 @@ func ListenForSignals() {
         }()
 }
 
-func RunClient(url string, id string, userKey string, rootPath string) {
-	rootPath, _ = filepath.Abs(rootPath)
+// Delays between attempts to (re)connect double up to the maximum, a
+// connection that stayed up longer than that starts over at the minimum
+const RECONNECT_MIN_DELAY = 100 * time.Millisecond
+const RECONNECT_MAX_DELAY = 30 * time.Second
+
+// Somewhere between half and all of delay, so clients that lost their
+// connection at the same time don't all come back at once
+func withJitter(delay time.Duration) time.Duration {
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Connects to the server and registers the session
+func dialServer(config *websocket.Config, id string, options ClientOptions, reconnect bool) (*websocket.Conn, error) {
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	buffer, _ := json.Marshal(HelloMessage{"0.1", id, options.UserKey, options.Secret, reconnect})
+	if _, err := ws.Write(buffer); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+func RunClient(id string, options ClientOptions) {
+	url := options.Url
+	userKey := options.UserKey
+	rootPath, _ := filepath.Abs(options.RootPath)
         ListenForSignals()
 	socketUrl := fmt.Sprintf("%s/clientsocket", url)
-	var ws *websocket.Conn
-	var timeout time.Duration = 1e8
 	config, err := websocket.NewConfig(socketUrl, socketUrl)
 	if err != nil {
 		fmt.Println(err)
@@ -454,42 +1116,82 @@ func RunClient(url string, id string, userKey string, rootPath string) {
 	config.TlsConfig = new(tls.Config)
 	// Disable this when getting a proper certificate
 	config.TlsConfig.InsecureSkipVerify = true
+
+	var handler RPCHandler
+	if len(options.Roots) > 0 {
+		handler = NewMultiRootHandler(options)
+	} else {
+		handler = NewRootedRPCHandler(rootPath, options)
+	}
+	connectUrl := strings.Replace(url, "ws://", "http://", 1)
+	connectUrl = strings.Replace(connectUrl, "wss://", "https://", 1)
+	connected := false
+	delay := RECONNECT_MIN_DELAY
 	for {
-		time.Sleep(timeout)
-		var err error
-		ws, err = websocket.DialConfig(config)
-		timeout *= 2
+		ws, err := dialServer(config, id, options, connected)
 		if err != nil {
-			fmt.Println("Could not yet connect:", err.Error(), ", trying again in", timeout)
-		} else {
-			break
+			wait := withJitter(delay)
+			fmt.Println("Could not connect:", err.Error(), ", trying again in", wait)
+			time.Sleep(wait)
+			if delay *= 2; delay > RECONNECT_MAX_DELAY {
+				delay = RECONNECT_MAX_DELAY
+			}
+			continue
 		}
-	}
 
-	buffer, _ := json.Marshal(HelloMessage{"0.1", id, userKey})
+		if connected {
+			fmt.Println("Reconnected.")
+		} else if userKey == "" {
+        		fmt.Print("In the Zed application copy and paste following URL to edit:\n\n")
+        		fmt.Printf("  %s/fs/%s\n\n", connectUrl, id)
+        		for _, root := range options.Roots {
+        			fmt.Printf("  %s/fs/%s/%s/ for %s\n", connectUrl, id, root.Name, root.Path)
+        		}
+		} else {
+                	fmt.Println("A Zed window should now open. If not, make sure Zed is running and configured with the correct userKey.")
+		}
+		if !connected {
+			if options.Rev != "" {
+				fmt.Println("Sharing revision", options.Rev, "read-only.")
+			} else if options.ReadOnly {
+				fmt.Println("Sharing in read-only mode, all writes will be refused.")
+			}
+			fmt.Println("Press Ctrl-c to quit.")
+			connected = true
+		}
 
-	if _, err := ws.Write(buffer); err != nil {
-		log.Fatal(err)
-		return
-	}
-	connectUrl := strings.Replace(url, "ws://", "http://", 1)
-	connectUrl = strings.Replace(connectUrl, "wss://", "https://", 1)
-	multiplexer := NewRPCMultiplexer(ws, &RootedRPCHandler{rootPath})
-
-        if userKey == "" {
-        	fmt.Print("In the Zed application copy and paste following URL to edit:\n\n")
-        	fmt.Printf("  %s/fs/%s\n\n", connectUrl, id)
-        } else {
-                fmt.Println("A Zed window should now open. If not, make sure Zed is running and configured with the correct userKey.")
-        }
-	fmt.Println("Press Ctrl-c to quit.")
-	err = multiplexer.Multiplex()
-	if err != nil {
-		// TODO do this in a cleaner way (reconnect, that is)
-		if err.Error() == "no-client" {
+		started := time.Now()
+		// The same session id is registered again on every connection, so
+		// the server can retry requests that were cut off
+		multiplexer := NewRPCMultiplexer(ws, handler)
+		err = multiplexer.Multiplex()
+		ws.Close()
+		switch err.Error() {
+		case "no-client":
 		        fmt.Printf("ERROR: Your Zed editor is not currently connected to zedrem server %s.\nBe sure Zed is running and the project picker is open.\n", url)
-		} else {
-		        RunClient(url, id, userKey, rootPath)
+		        return
+		case SESSION_TAKEN:
+		        fmt.Printf("ERROR: Session %s is in use by another client of zedrem server %s.\n", id, url)
+		        return
+		case SESSION_REPLACED:
+		        fmt.Printf("Session %s was taken over by another client, stopping.\n", id)
+		        return
+		}
+		if time.Since(started) > RECONNECT_MAX_DELAY {
+			delay = RECONNECT_MIN_DELAY
+		}
+		wait := withJitter(delay)
+		fmt.Println("Connection lost:", err.Error(), ", reconnecting in", wait)
+		// The server retries the cut off requests on the next connection,
+		// their handlers need to have let go of their write locks by then
+		select {
+		case <-multiplexer.stopped:
+		case <-time.After(RECONNECT_MAX_DELAY):
+			fmt.Println("Requests of the lost connection still running, reconnecting anyway")
+		}
+		time.Sleep(wait)
+		if delay *= 2; delay > RECONNECT_MAX_DELAY {
+			delay = RECONNECT_MAX_DELAY
 		}
 	}
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"gopkg.in/gcfg.v1"
 	"os"
+	"path/filepath"
 	"fmt"
 )
 
@@ -10,19 +11,52 @@ type Config struct {
     Client struct {
         Url string
         UserKey string
+        ReadOnly bool
+        Include []string
+        Exclude []string
+        FilelistExclude []string
+        Trash bool
+        TrashRetention string
+        HistoryDir string
+        HistoryVersions int
+        UploadExpiry string
+        ExecAllow []string
+        Persist bool
     }
 
+    Lsp map[string]*LanguageServerConfig
+
+    Root map[string]*RootConfig
+
     Server struct {
         Ip string
         Port int
         Sslcert string
         Sslkey string
+        ReconnectGrace string
     }
 }
 
+// A [root "name"] section, applying to the root of that name when serving
+// several, on top of the [client] settings
+type RootConfig struct {
+    ReadOnly bool
+    Include []string
+    Exclude []string
+}
+
+// A [lsp "name"] section
+type LanguageServerConfig struct {
+    Command string
+    Arg []string
+    Extension []string
+}
+
 func ParseConfig() Config {
     var config Config
     config.Client.Url = "wss://remote.zedapp.org:443"
+    config.Client.Trash = true
+    config.Client.HistoryVersions = DEFAULT_HISTORY_VERSIONS
     config.Server.Ip = "0.0.0.0"
     config.Server.Port = 7337
 
@@ -37,3 +71,19 @@ func ParseConfig() Config {
 
     return config
 }
+
+// Reads the project specific .zedremrc file in rootPath, if any
+func ParseProjectConfig(fs FileSystem, rootPath string) Config {
+    var config Config
+
+    configFile := filepath.Join(rootPath, ".zedremrc")
+    if content, err := readFile(fs, configFile); err == nil {
+        err = gcfg.ReadStringInto(&config, string(content))
+        if err != nil {
+            fmt.Println("Could not read project config file", configFile, err);
+            os.Exit(4)
+        }
+    }
+
+    return config
+}
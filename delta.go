@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const DELTA_CONTENT_TYPE = "application/x-zedrem-delta"
+
+// Binary deltas are a sequence of operations, each starting with a byte:
+//
+//	'C' <uvarint offset> <uvarint length>  copy a range of the base file
+//	'I' <uvarint length> <data>             insert literal data
+func applyDelta(base []byte, delta []byte) ([]byte, error) {
+	var result bytes.Buffer
+	reader := bytes.NewReader(delta)
+	for {
+		op, err := reader.ReadByte()
+		if err == io.EOF {
+			return result.Bytes(), nil
+		}
+		switch op {
+		case 'C':
+			offset, err1 := binary.ReadUvarint(reader)
+			length, err2 := binary.ReadUvarint(reader)
+			if err1 != nil || err2 != nil {
+				return nil, errors.New("Truncated copy operation")
+			}
+			if offset > uint64(len(base)) || length > uint64(len(base))-offset {
+				return nil, errors.New("Copy operation out of range")
+			}
+			result.Write(base[offset : offset+length])
+		case 'I':
+			length, err := binary.ReadUvarint(reader)
+			if err != nil || length > uint64(reader.Len()) {
+				return nil, errors.New("Truncated insert operation")
+			}
+			data := make([]byte, length)
+			reader.Read(data)
+			result.Write(data)
+		default:
+			return nil, errors.New("Unknown delta operation")
+		}
+	}
+}
+
+// Applies a unified diff (the default) or a binary delta to a file. The
+// If-Match header must carry the ETag of the version the patch is based on.
+func (self *RootedRPCHandler) handlePatch(req *rpcRequest, requestChannel chan []byte, responseChannel chan []byte) HttpError {
+	path := req.path
+	body, httpErr := readWholeBody(requestChannel)
+	if httpErr != nil {
+		return httpErr
+	}
+	if !self.acquireWriteLock(path) {
+		return NewHttpError(http.StatusConflict, "Write already going on")
+	}
+	defer self.releaseWriteLock(path)
+
+	safePath, httpErr := self.resolvePath(path)
+	if httpErr != nil {
+		return httpErr
+	}
+	stat, err := self.fs.Stat(safePath)
+	if err != nil {
+		return fileError(err, "Could not read file")
+	}
+	if stat.IsDir() {
+		return NewHttpError(http.StatusMethodNotAllowed, "Cannot patch a directory")
+	}
+	baseETag := strings.Trim(req.header.Get("If-Match"), "\"")
+	if baseETag == "" {
+		return NewHttpError(http.StatusPreconditionRequired, "If-Match header with the base ETag required")
+	}
+	if baseETag != stat.ModTime().String() {
+		return NewHttpError(http.StatusPreconditionFailed, "File changed since the base version")
+	}
+	base, err := readFile(self.fs, safePath)
+	if err != nil {
+		return fileError(err, "Could not read file")
+	}
+
+	var patched []byte
+	if strings.HasPrefix(req.header.Get("Content-Type"), DELTA_CONTENT_TYPE) {
+		patched, err = applyDelta(base, body)
+	} else {
+		var text string
+		text, err = applyUnifiedDiff(string(base), string(body))
+		patched = []byte(text)
+	}
+	if err != nil {
+		return NewHttpError(http.StatusUnprocessableEntity, "Could not apply patch: "+err.Error())
+	}
+
+	if httpErr := self.writeFile(safePath, bytes.NewReader(patched)); httpErr != nil {
+		return httpErr
+	}
+	stat, _ = self.fs.Stat(safePath)
+	responseChannel <- statusCodeBuffer(200)
+	responseChannel <- headerBuffer(map[string]string{
+		"Content-Type": "text/plain",
+		"ETag":         stat.ModTime().String(),
+	})
+	responseChannel <- []byte("OK")
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// Splits text into lines, keeping the line endings
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Edit steps after which diffLines stops looking for a shortest edit script
+// and replaces all changed lines instead. What it keeps for backtracking
+// grows with the square of the steps.
+const MAX_DIFF_STEPS = 2000
+
+// Computes an edit script from a to b. Lines common to the start and end
+// are kept as they are, the rest is diffed with Myers' algorithm.
+func diffLines(a []string, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	var ops []diffOp
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	ops = append(ops, myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// Shortest edit script, or after MAX_DIFF_STEPS one replacing everything.
+// Each step only keeps the diagonals it can have reached.
+func myersDiff(a []string, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	v := make([]int, 2*max+2)
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		if d > MAX_DIFF_STEPS {
+			return replaceLines(a, b)
+		}
+		// Diagonals -d-1 to d+1, see backtrackDiff
+		low, high := max-d-1, max+d+2
+		if low < 0 {
+			low = 0
+		}
+		if high > len(v) {
+			high = len(v)
+		}
+		step := make([]int, 2*d+3)
+		copy(step[low-(max-d-1):], v[low:high])
+		trace = append(trace, step)
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[max+k-1] < v[max+k+1]) {
+				x = v[max+k+1]
+			} else {
+				x = v[max+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[max+k] = x
+			if x >= n && y >= m {
+				return backtrackDiff(trace, a, b)
+			}
+		}
+	}
+	return nil
+}
+
+func replaceLines(a []string, b []string) []diffOp {
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, line := range a {
+		ops = append(ops, diffOp{'-', line})
+	}
+	for _, line := range b {
+		ops = append(ops, diffOp{'+', line})
+	}
+	return ops
+}
+
+// Walks back through the steps, trace[d] holds diagonal k at index k+d+1
+func backtrackDiff(trace [][]int, a []string, b []string) []diffOp {
+	var ops []diffOp
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		offset := d + 1
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{'+', b[y-1]})
+			} else {
+				ops = append(ops, diffOp{'-', a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+func writeDiffLine(out *bytes.Buffer, kind byte, line string) {
+	out.WriteByte(kind)
+	out.WriteString(line)
+	if !strings.HasSuffix(line, "\n") {
+		out.WriteString("\n\\ No newline at end of file\n")
+	}
+}
+
+// Produces a unified diff with the given number of context lines, or an
+// empty string when both texts are equal
+func unifiedDiff(aName string, bName string, a string, b string, context int) string {
+	ops := diffLines(splitLines(a), splitLines(b))
+	var out bytes.Buffer
+	// Position of each op in a and b
+	aLine := make([]int, len(ops)+1)
+	bLine := make([]int, len(ops)+1)
+	for i, op := range ops {
+		aLine[i+1], bLine[i+1] = aLine[i], bLine[i]
+		if op.kind != '+' {
+			aLine[i+1]++
+		}
+		if op.kind != '-' {
+			bLine[i+1]++
+		}
+	}
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// Extend the hunk while changes are close enough to share context
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			} else if j-end >= 2*context {
+				break
+			}
+		}
+		end += context
+		if end > len(ops) {
+			end = len(ops)
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+		}
+		aStart, bStart := aLine[start]+1, bLine[start]+1
+		aCount, bCount := aLine[end]-aLine[start], bLine[end]-bLine[start]
+		if aCount == 0 {
+			aStart--
+		}
+		if bCount == 0 {
+			bStart--
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+		for _, op := range ops[start:end] {
+			writeDiffLine(&out, op.kind, op.line)
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// Parses a hunk header "@@ -start[,count] +start[,count] @@", where a range
+// without a count has one line
+func parseHunkHeader(header string) (oldStart int, oldLines int, newStart int, newLines int, err error) {
+	fields := strings.Fields(header)
+	if len(fields) < 4 || fields[0] != "@@" || fields[3] != "@@" {
+		err = fmt.Errorf("Invalid hunk header: %s", strings.TrimSpace(header))
+		return
+	}
+	oldStart, oldLines, err = parseHunkRange(fields[1], "-")
+	if err == nil {
+		newStart, newLines, err = parseHunkRange(fields[2], "+")
+	}
+	if err != nil {
+		err = fmt.Errorf("Invalid hunk header: %s", strings.TrimSpace(header))
+	}
+	return
+}
+
+func parseHunkRange(field string, sign string) (start int, lines int, err error) {
+	if !strings.HasPrefix(field, sign) {
+		return 0, 0, errors.New("Missing " + sign)
+	}
+	parts := strings.SplitN(field[1:], ",", 2)
+	if start, err = strconv.Atoi(parts[0]); err != nil || start < 0 {
+		return 0, 0, errors.New("Invalid start")
+	}
+	lines = 1
+	if len(parts) == 2 {
+		if lines, err = strconv.Atoi(parts[1]); err != nil || lines < 0 {
+			return 0, 0, errors.New("Invalid count")
+		}
+	}
+	return start, lines, nil
+}
+
+// Applies a unified diff to text. Every hunk's context and removed lines
+// must match exactly and its line counts the header, otherwise an error is
+// returned.
+func applyUnifiedDiff(text string, diff string) (string, error) {
+	lines := splitLines(text)
+	diffLines := splitLines(diff)
+	var result []string
+	pos := 0
+	i := 0
+	for i < len(diffLines) && !strings.HasPrefix(diffLines[i], "@@") {
+		i++
+	}
+	for i < len(diffLines) {
+		header := diffLines[i]
+		aStart, aCount, _, bCount, err := parseHunkHeader(header)
+		if err != nil {
+			return "", err
+		}
+		i++
+		start := aStart - 1
+		if aCount == 0 {
+			start = aStart
+		}
+		if start < pos || start > len(lines) {
+			return "", fmt.Errorf("Hunk out of range: %s", strings.TrimSpace(header))
+		}
+		result = append(result, lines[pos:start]...)
+		pos = start
+		oldLines, newLines := 0, 0
+		for ; i < len(diffLines) && !strings.HasPrefix(diffLines[i], "@@"); i++ {
+			line := diffLines[i]
+			if strings.HasPrefix(line, "\\") {
+				// No newline at end of file, applies to the previous line
+				if len(result) > 0 && strings.HasPrefix(diffLines[i-1], "+") {
+					result[len(result)-1] = strings.TrimSuffix(result[len(result)-1], "\n")
+				}
+				continue
+			}
+			if line == "" || line == "\n" {
+				line = " \n"
+			}
+			kind, content := line[0], line[1:]
+			switch kind {
+			case ' ', '-':
+				if pos >= len(lines) || strings.TrimSuffix(lines[pos], "\n") != strings.TrimSuffix(content, "\n") {
+					return "", fmt.Errorf("Patch does not apply at line %d", pos+1)
+				}
+				if kind == ' ' {
+					result = append(result, lines[pos])
+					newLines++
+				}
+				pos++
+				oldLines++
+			case '+':
+				result = append(result, content)
+				newLines++
+			default:
+				return "", fmt.Errorf("Invalid diff line: %s", strings.TrimSpace(line))
+			}
+		}
+		if oldLines != aCount || newLines != bCount {
+			return "", fmt.Errorf("Hunk does not match its header: %s", strings.TrimSpace(header))
+		}
+	}
+	result = append(result, lines[pos:]...)
+	return strings.Join(result, ""), nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\n"
+	b := "one\n2\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\neleven\n"
+	expected := `--- a
++++ b
+@@ -1,5 +1,5 @@
+ one
+-two
++2
+ three
+ four
+ five
+@@ -8,3 +8,4 @@
+ eight
+ nine
+ ten
++eleven
+`
+	if diff := unifiedDiff("a", "b", a, b, 3); diff != expected {
+		t.Errorf("Unexpected diff:\n%s", diff)
+	}
+	if diff := unifiedDiff("a", "b", a, a, 3); diff != "" {
+		t.Errorf("Equal texts should not differ:\n%s", diff)
+	}
+}
+
+func TestApplyUnifiedDiff(t *testing.T) {
+	cases := [][2]string{
+		{"one\ntwo\nthree\n", "one\n2\nthree\nfour"},
+		{"", "new\n"},
+		{"a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n", "b\nc\nd\ne\nf\ng\nh\ni\nJ\n"},
+	}
+	for _, c := range cases {
+		diff := unifiedDiff("a", "b", c[0], c[1], 3)
+		result, err := applyUnifiedDiff(c[0], diff)
+		if err != nil || result != c[1] {
+			t.Errorf("Applying diff to %q gave %q, %v", c[0], result, err)
+		}
+	}
+	diff := unifiedDiff("a", "b", "one\ntwo\n", "one\n2\n", 3)
+	if _, err := applyUnifiedDiff("one\nthree\n", diff); err == nil {
+		t.Errorf("Diff should not apply to changed text")
+	}
+}
+
+func TestApplyHunkHeaders(t *testing.T) {
+	cases := []struct {
+		text   string
+		diff   string
+		result string
+	}{
+		{"", "@@ -0,0 +1 @@\n+new\n", "new\n"},
+		{"one\n", "@@ -1 +1,2 @@\n one\n+two\n", "one\ntwo\n"},
+		{"one\ntwo\n", "@@ -1,2 +1 @@ context\n one\n-two\n", "one\n"},
+	}
+	for _, c := range cases {
+		if result, err := applyUnifiedDiff(c.text, c.diff); err != nil || result != c.result {
+			t.Errorf("Applying %q gave %q, %v", c.diff, result, err)
+		}
+	}
+	for _, diff := range []string{"@@ -1,2 +1,2 @@\n one\n", "@@ -1 +1 @@\n one\n+two\n", "@@ -x +1 @@\n one\n"} {
+		if _, err := applyUnifiedDiff("one\ntwo\n", diff); err == nil {
+			t.Errorf("Applied invalid hunk %q", diff)
+		}
+	}
+}
+
+func TestDiffRandomTexts(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	text := func() string {
+		lines := make([]string, random.Intn(30))
+		for i := range lines {
+			lines[i] = fmt.Sprintf("%d\n", random.Intn(5))
+		}
+		return strings.Join(lines, "")
+	}
+	for i := 0; i < 500; i++ {
+		a, b := text(), text()
+		if result, err := applyUnifiedDiff(a, unifiedDiff("a", "b", a, b, random.Intn(4))); err != nil || result != b {
+			t.Fatalf("Applying diff of %q to %q gave %q, %v", a, b, result, err)
+		}
+	}
+}
+
+func TestDiffLargeText(t *testing.T) {
+	lines := make([]string, 200000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d\n", i)
+	}
+	a := strings.Join(lines, "")
+	for i := 0; i < 40; i++ {
+		lines[i*5000+7] = "changed\n"
+	}
+	b := strings.Join(lines, "")
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	diff := unifiedDiff("a", "b", a, b, 3)
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 100<<20 {
+		t.Errorf("Diff allocated %d MB", allocated>>20)
+	}
+	if result, err := applyUnifiedDiff(a, diff); err != nil || result != b {
+		t.Errorf("Diff of large text does not apply: %v", err)
+	}
+
+	// Past MAX_DIFF_STEPS everything in between is replaced
+	for i := range lines {
+		lines[i] = fmt.Sprintf("other %d\n", i)
+	}
+	b = strings.Join(lines[:MAX_DIFF_STEPS*2], "")
+	a = strings.Join(lines[MAX_DIFF_STEPS*2:MAX_DIFF_STEPS*4], "")
+	if result, err := applyUnifiedDiff(a, unifiedDiff("a", "b", a, b, 3)); err != nil || result != b {
+		t.Errorf("Replacing diff does not apply: %v", err)
+	}
+}
+
+func TestApplyDelta(t *testing.T) {
+	delta := []byte{'C', 6, 5, 'I', 1, ' ', 'C', 0, 5}
+	if result, err := applyDelta([]byte("hello world"), delta); err != nil || string(result) != "world hello" {
+		t.Errorf("Unexpected delta result %q, %v", result, err)
+	}
+	if _, err := applyDelta([]byte("short"), []byte{'C', 3, 5}); err == nil {
+		t.Errorf("Copy beyond the base should fail")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+const EXEC_CONTENT_TYPE = "application/x-zedrem-exec"
+
+// Kinds of frames in an exec response. Each frame is the kind byte, a 4 byte
+// big endian length and the data. The exit frame is always last and holds the
+// exit status as a decimal number (-1 if the command was killed).
+const (
+	EXEC_STDOUT = 'o'
+	EXEC_STDERR = 'e'
+	EXEC_EXIT   = 'x'
+)
+
+func execFrame(kind byte, data []byte) []byte {
+	frame := make([]byte, 5+len(data))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(data)))
+	copy(frame[5:], data)
+	return frame
+}
+
+// Sends everything read from r as frames of the given kind
+func streamExecOutput(r io.Reader, kind byte, responseChannel chan []byte) {
+	for {
+		buffer := make([]byte, BUFFER_SIZE-5)
+		n, err := r.Read(buffer)
+		if n > 0 {
+			responseChannel <- execFrame(kind, buffer[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Runs cmd with the arg values as arguments in the directory posted to.
+// Only commands on the execallow list in ~/.zedremrc can be run, on purpose
+// not in the project's .zedremrc.
+func (self *RootedRPCHandler) handleExec(dirPath string, queryValues url.Values, requestChannel chan []byte, responseChannel chan []byte) HttpError {
+	name := queryValues.Get("cmd")
+	if len(self.execAllow) == 0 {
+		return NewHttpError(http.StatusForbidden, "Exec is disabled")
+	}
+	if !self.execAllow[name] {
+		return NewHttpError(http.StatusForbidden, "Command not allowed: "+name)
+	}
+	if stat, err := os.Stat(dirPath); err != nil || !stat.IsDir() {
+		return NewHttpError(http.StatusBadRequest, "Working directory is not a directory")
+	}
+	cmd := exec.Command(name, queryValues["arg"]...)
+	cmd.Dir = dirPath
+	setProcessGroup(cmd)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return NewHttpError(http.StatusInternalServerError, err.Error())
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return NewHttpError(http.StatusInternalServerError, err.Error())
+	}
+	if err := cmd.Start(); err != nil {
+		return NewHttpError(http.StatusInternalServerError, "Could not start command: "+err.Error())
+	}
+	done := make(chan bool)
+	defer close(done)
+	cancelled := cancelNotifier(requestChannel)
+	go func() {
+		select {
+		case <-cancelled:
+			// Children may keep the pipes open, so they're closed as well
+			killProcessGroup(cmd)
+			stdout.Close()
+			stderr.Close()
+		case <-done:
+		}
+	}()
+
+	responseChannel <- statusCodeBuffer(200)
+	responseChannel <- headerBuffer(map[string]string{"Content-Type": EXEC_CONTENT_TYPE})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		streamExecOutput(stdout, EXEC_STDOUT, responseChannel)
+		wg.Done()
+	}()
+	go func() {
+		streamExecOutput(stderr, EXEC_STDERR, responseChannel)
+		wg.Done()
+	}()
+	wg.Wait()
+	exitCode := 0
+	if err := cmd.Wait(); err != nil {
+		exitCode = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitCode = exitErr.ExitCode()
+		}
+	}
+	responseChannel <- execFrame(EXEC_EXIT, []byte(strconv.Itoa(exitCode)))
+	return nil
+}
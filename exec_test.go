@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/url"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCancelExecWithChildren(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("No process groups")
+	}
+	handler := NewRootedRPCHandler(t.TempDir(), ClientOptions{ExecAllow: []string{"sh"}})
+	requestChannel := make(chan []byte, 10)
+	responseChannel := make(chan []byte, 100)
+	requestChannel <- []byte("POST /")
+	requestChannel <- []byte("")
+	requestChannel <- []byte("action=exec&cmd=sh&arg=-c&arg=" + url.QueryEscape("sleep 30 & sleep 30"))
+	requestChannel <- DELIMITERBUFFER
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		requestChannel <- CANCELBUFFER
+	}()
+	done := make(chan bool)
+	go func() {
+		handler.handleRequest(requestChannel, responseChannel, make(chan bool, 1))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Exec kept running after cancel")
+	}
+}
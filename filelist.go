@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Number of directories read in parallel while walking
+const WALK_CONCURRENCY = 8
+
+// Last line of a filelist cut off at its limit, paths all start with /
+const FILELIST_TRUNCATED = "...truncated"
+
+var defaultWalkExcludes = []string{".git/", "node_modules/"}
+
+type walkOptions struct {
+	maxDepth   int
+	maxEntries int
+	gitignore  bool
+	follow     bool
+	exclude    *ignoreList
+}
+
+// Options can be passed in the POST body: depth, limit, gitignore=false,
+// follow=true and any number of exclude patterns.
+func parseWalkOptions(queryValues url.Values, defaultExcludes []string) walkOptions {
+	options := walkOptions{gitignore: true}
+	options.maxDepth, _ = strconv.Atoi(queryValues.Get("depth"))
+	options.maxEntries, _ = strconv.Atoi(queryValues.Get("limit"))
+	if queryValues.Get("gitignore") == "false" {
+		options.gitignore = false
+	}
+	if queryValues.Get("follow") == "true" {
+		options.follow = true
+	}
+	exclude := append([]string{}, defaultExcludes...)
+	exclude = append(exclude, queryValues["exclude"]...)
+	options.exclude = newIgnoreList("", exclude)
+	return options
+}
+
+// Walks a directory tree with WALK_CONCURRENCY workers reading directories
+// from a queue, calling emit for every file found. Paths passed to emit are
+// relative to the walked directory.
+type fileWalker struct {
+	handler *RootedRPCHandler
+	root    string
+	options walkOptions
+	emit    func(relPath string, absPath string, f os.FileInfo)
+
+	lock      sync.Mutex
+	queued    *sync.Cond
+	queue     []walkJob
+	active    int
+	visited   map[string]bool
+	count     int
+	truncated bool
+	stopped   bool
+	stop      chan bool
+}
+
+// A directory waiting to be read
+type walkJob struct {
+	dir     string
+	relDir  string
+	depth   int
+	ignores []*ignoreList
+	// Whether dir was reached through a symlink
+	linked bool
+}
+
+func newFileWalker(handler *RootedRPCHandler, root string, options walkOptions) *fileWalker {
+	w := &fileWalker{
+		handler: handler,
+		root:    root,
+		options: options,
+		visited: make(map[string]bool),
+		stop:    make(chan bool),
+	}
+	w.queued = sync.NewCond(&w.lock)
+	return w
+}
+
+// Stops the walk, may be called more than once and from any goroutine
+func (w *fileWalker) Stop() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.stopped {
+		w.stopped = true
+		close(w.stop)
+		w.queued.Broadcast()
+	}
+}
+
+// Whether the walk stopped at maxEntries, leaving files out
+func (w *fileWalker) Truncated() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.truncated
+}
+
+func (w *fileWalker) isStopped() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Walks the tree and blocks until done
+func (w *fileWalker) Walk() {
+	var ignores []*ignoreList
+	if w.options.gitignore {
+		// .gitignore files from the root down to the walked directory apply too
+		relRoot := w.handler.relativePath(w.root)
+		dir := ""
+		ignores = w.addIgnoreFile(ignores, w.handler.rootPath, "")
+		if relRoot != "." {
+			for _, part := range strings.Split(relRoot, "/") {
+				dir = strings.TrimPrefix(dir+"/"+part, "/")
+				ignores = w.addIgnoreFile(ignores, filepath.Join(w.handler.rootPath, dir), dir)
+			}
+		}
+	}
+	if realPath, err := w.handler.fs.EvalSymlinks(w.root); err == nil {
+		w.visited[realPath] = true
+	}
+	w.queue = append(w.queue, walkJob{w.root, "", 1, ignores, false})
+	var workers sync.WaitGroup
+	for i := 0; i < WALK_CONCURRENCY; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			w.work()
+		}()
+	}
+	workers.Wait()
+}
+
+// Reads directories from the queue until it is empty and no other worker
+// can add to it anymore, or the walk is stopped
+func (w *fileWalker) work() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for {
+		for len(w.queue) == 0 && w.active > 0 && !w.stopped {
+			w.queued.Wait()
+		}
+		if len(w.queue) == 0 || w.stopped {
+			w.queued.Broadcast()
+			return
+		}
+		job := w.queue[len(w.queue)-1]
+		w.queue = w.queue[:len(w.queue)-1]
+		w.active++
+		w.lock.Unlock()
+		w.walkDirectory(job)
+		w.lock.Lock()
+		w.active--
+		w.queued.Broadcast()
+	}
+}
+
+func (w *fileWalker) enqueue(job walkJob) {
+	w.lock.Lock()
+	w.queue = append(w.queue, job)
+	w.lock.Unlock()
+	w.queued.Signal()
+}
+
+func (w *fileWalker) addIgnoreFile(ignores []*ignoreList, dir string, base string) []*ignoreList {
+	f, err := w.handler.fs.Open(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return ignores
+	}
+	list := parseIgnoreFile(base, f)
+	f.Close()
+	if list == nil {
+		return ignores
+	}
+	// Copy, sibling directories share the parent's slice
+	return append(append([]*ignoreList{}, ignores...), list)
+}
+
+func (w *fileWalker) isIgnored(ignores []*ignoreList, absPath string, relPath string, isDir bool) bool {
+	if w.handler.isHidden(absPath, isDir) {
+		return true
+	}
+	if w.options.exclude.ignores(relPath, isDir) {
+		return true
+	}
+	rootRelPath := w.handler.relativePath(absPath)
+	for _, list := range ignores {
+		if _, ignored := list.match(rootRelPath, isDir); ignored {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *fileWalker) walkDirectory(job walkJob) {
+	dir, relDir, depth, ignores := job.dir, job.relDir, job.depth, job.ignores
+	if w.isStopped() {
+		return
+	}
+	files, err := w.handler.fs.ReadDir(dir)
+	if err != nil {
+		fmt.Println("Could not read directory", dir, err)
+		return
+	}
+	if w.options.gitignore && relDir != "" {
+		ignores = w.addIgnoreFile(ignores, dir, w.handler.relativePath(dir))
+	}
+	for _, f := range files {
+		absPath := filepath.Join(dir, f.Name())
+		relPath := strings.TrimPrefix(relDir+"/"+f.Name(), "/")
+		isDir := f.IsDir()
+		linked := job.linked || f.Mode()&os.ModeSymlink != 0
+		if linked && w.handler.hidesRealPath(absPath) {
+			continue
+		}
+		if !isDir && w.options.follow && f.Mode()&os.ModeSymlink != 0 {
+			if stat, err := w.handler.fs.Stat(absPath); err == nil {
+				isDir = stat.IsDir()
+			}
+		}
+		if w.isIgnored(ignores, absPath, relPath, isDir) {
+			continue
+		}
+		if isDir {
+			if w.options.maxDepth > 0 && depth >= w.options.maxDepth {
+				continue
+			}
+			if !w.markVisited(absPath) {
+				continue
+			}
+			w.enqueue(walkJob{absPath, relPath, depth + 1, ignores, linked})
+		} else {
+			if !w.countEntry() {
+				return
+			}
+			w.emit(relPath, absPath, f)
+		}
+	}
+}
+
+// Guards against symlink cycles, returns false when the directory was seen before
+func (w *fileWalker) markVisited(absPath string) bool {
+	realPath, err := w.handler.fs.EvalSymlinks(absPath)
+	if err != nil {
+		return false
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.visited[realPath] {
+		return false
+	}
+	w.visited[realPath] = true
+	return true
+}
+
+func (w *fileWalker) countEntry() bool {
+	w.lock.Lock()
+	w.count++
+	limitReached := w.options.maxEntries > 0 && w.count > w.options.maxEntries
+	if limitReached {
+		w.truncated = true
+	}
+	w.lock.Unlock()
+	if limitReached {
+		w.Stop()
+	}
+	return !limitReached
+}
+
+// Collects lines and sends them as buffers of up to BUFFER_SIZE, never
+// splitting a line over two buffers
+type lineStreamer struct {
+	lock            sync.Mutex
+	buffer          bytes.Buffer
+	responseChannel chan []byte
+}
+
+func (s *lineStreamer) WriteLine(line string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.buffer.Len()+len(line)+1 > BUFFER_SIZE {
+		s.flush()
+	}
+	s.buffer.WriteString(line)
+	s.buffer.WriteByte('\n')
+}
+
+func (s *lineStreamer) Flush() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.flush()
+}
+
+func (s *lineStreamer) flush() {
+	if s.buffer.Len() == 0 {
+		return
+	}
+	// A single line can be longer than a buffer
+	(&channelWriter{s.responseChannel}).Write(s.buffer.Bytes())
+	s.buffer.Reset()
+}
+
+// Streams the files below dirPath, one /path per line. A list cut off at
+// the limit ends with a FILELIST_TRUNCATED line.
+func (self *RootedRPCHandler) handleFileList(dirPath string, queryValues url.Values, requestChannel chan []byte, responseChannel chan []byte) HttpError {
+	if _, err := self.fs.ReadDir(dirPath); err != nil {
+		return NewHttpError(http.StatusInternalServerError, "Could not read directory")
+	}
+	walker := newFileWalker(self, dirPath, parseWalkOptions(queryValues, self.walkExcludes))
+	streamer := &lineStreamer{responseChannel: responseChannel}
+	walker.emit = func(relPath string, absPath string, f os.FileInfo) {
+		streamer.WriteLine("/" + relPath)
+	}
+	cancelled := cancelNotifier(requestChannel)
+	go func() {
+		<-cancelled
+		walker.Stop()
+	}()
+
+	responseChannel <- statusCodeBuffer(200)
+	responseChannel <- headerBuffer(map[string]string{
+		"Content-Type": "text/plain",
+	})
+	walker.Walk()
+	if walker.Truncated() {
+		streamer.WriteLine(FILELIST_TRUNCATED)
+	}
+	streamer.Flush()
+	return nil
+}
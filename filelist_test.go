@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileListLimit(t *testing.T) {
+	root := filepath.FromSlash("/project")
+	fs := newMemoryFileSystem(root)
+	for i := 0; i < 200; i++ {
+		fs.WriteFile(filepath.Join(root, fmt.Sprintf("dir%d/sub/file.txt", i)), strings.NewReader("x"))
+	}
+	handler := NewRootedRPCHandler(root, ClientOptions{FileSystem: fs})
+
+	_, body := testRequest(handler, "POST /", "", "action=filelist")
+	if lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n"); len(lines) != 200 || strings.Contains(body, FILELIST_TRUNCATED) {
+		t.Errorf("Unexpected complete filelist of %d lines", len(lines))
+	}
+	_, body = testRequest(handler, "POST /", "", "action=filelist&limit=50")
+	lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+	if len(lines) != 51 || lines[50] != FILELIST_TRUNCATED {
+		t.Errorf("Unexpected truncated filelist of %d lines ending in %q", len(lines), lines[len(lines)-1])
+	}
+	_, body = testRequest(handler, "POST /", "", "action=filelist&limit=200")
+	if strings.Contains(body, FILELIST_TRUNCATED) {
+		t.Errorf("Filelist at exactly the limit marked truncated")
+	}
+}
+
+type slowFileSystem struct {
+	FileSystem
+}
+
+func (fs slowFileSystem) ReadDir(absPath string) ([]os.FileInfo, error) {
+	time.Sleep(50 * time.Millisecond)
+	return fs.FileSystem.ReadDir(absPath)
+}
+
+func TestCancelFileList(t *testing.T) {
+	root := filepath.FromSlash("/project")
+	fs := newMemoryFileSystem(root)
+	fs.Mkdir(filepath.Join(root, strings.Repeat("d/", 100)), true)
+	handler := NewRootedRPCHandler(root, ClientOptions{FileSystem: slowFileSystem{fs}})
+	requestChannel := make(chan []byte, 10)
+	responseChannel := make(chan []byte, 100)
+	requestChannel <- []byte("POST /")
+	requestChannel <- []byte("")
+	requestChannel <- []byte("action=filelist")
+	requestChannel <- DELIMITERBUFFER
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		requestChannel <- CANCELBUFFER
+	}()
+	done := make(chan bool)
+	go func() {
+		handler.handleRequest(requestChannel, responseChannel, make(chan bool, 1))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("File list kept walking after cancel")
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Maps errors from the os package to a matching HTTP status
+func fileError(err error, message string) HttpError {
+	switch {
+	case os.IsNotExist(err):
+		return NewHttpError(http.StatusNotFound, "Not found")
+	case os.IsPermission(err):
+		return NewHttpError(http.StatusForbidden, "Permission denied")
+	case os.IsExist(err):
+		return NewHttpError(http.StatusConflict, "Already exists")
+	}
+	return NewHttpError(http.StatusInternalServerError, message+": "+err.Error())
+}
+
+// Copies a file, or with recursive a directory and everything in it,
+// keeping permissions
+func copyTree(source string, destination string, recursive bool) error {
+	stat, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	switch {
+	case stat.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, destination)
+	case stat.IsDir():
+		if err := os.Mkdir(destination, stat.Mode().Perm()); err != nil {
+			return err
+		}
+		if !recursive {
+			return nil
+		}
+		files, err := ioutil.ReadDir(source)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if err := copyTree(filepath.Join(source, f.Name()), filepath.Join(destination, f.Name()), true); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return copyFile(source, destination, stat.Mode().Perm())
+	}
+}
+
+func copyFile(source string, destination string, mode os.FileMode) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Resolves source and Destination header of a MOVE or COPY, and applies the
+// Overwrite header. Returns whether an existing destination is being replaced.
+func (self *RootedRPCHandler) prepareTransfer(req *rpcRequest) (source string, destination string, overwritten bool, httpErr HttpError) {
+	source, httpErr = self.resolvePath(req.path)
+	if httpErr != nil {
+		return
+	}
+	if _, err := self.fs.Lstat(source); err != nil {
+		httpErr = fileError(err, "Could not read source")
+		return
+	}
+	destinationPath := req.header.Get("Destination")
+	if destinationPath == "" {
+		httpErr = NewHttpError(http.StatusBadRequest, "No Destination header")
+		return
+	}
+	destination, httpErr = self.resolvePath(strings.TrimPrefix(destinationPath, "/"))
+	if httpErr != nil {
+		return
+	}
+	if source == self.rootPath || destination == self.rootPath {
+		httpErr = NewHttpError(http.StatusForbidden, "Cannot move or copy the root")
+		return
+	}
+	if destination == source || strings.HasPrefix(destination, source+string(filepath.Separator)) {
+		httpErr = NewHttpError(http.StatusForbidden, "Destination is inside source")
+		return
+	}
+	if _, err := self.fs.Stat(filepath.Dir(destination)); err != nil {
+		httpErr = NewHttpError(http.StatusConflict, "Destination directory does not exist")
+		return
+	}
+	if _, err := self.fs.Lstat(destination); err == nil {
+		if req.header.Get("Overwrite") == "F" {
+			httpErr = NewHttpError(http.StatusPreconditionFailed, "Destination already exists")
+			return
+		}
+		overwritten = true
+	}
+	return
+}
+
+func sendTransferResponse(responseChannel chan []byte, overwritten bool) {
+	if overwritten {
+		responseChannel <- statusCodeBuffer(http.StatusNoContent)
+		responseChannel <- headerBuffer(map[string]string{"Content-Length": "0"})
+	} else {
+		sendCreated(responseChannel)
+	}
+}
+
+// Source and destination of a MOVE or COPY in a fixed order, to avoid
+// deadlocks, and only once when they are the same
+func (self *RootedRPCHandler) transferPaths(req *rpcRequest) []string {
+	paths := []string{req.path, strings.TrimPrefix(req.header.Get("Destination"), "/")}
+	switch {
+	case self.lockKey(paths[0]) == self.lockKey(paths[1]):
+		return paths[:1]
+	case self.lockKey(paths[0]) > self.lockKey(paths[1]):
+		paths[0], paths[1] = paths[1], paths[0]
+	}
+	return paths
+}
+
+func (self *RootedRPCHandler) lockTransfer(req *rpcRequest) bool {
+	paths := self.transferPaths(req)
+	for i, path := range paths {
+		if !self.acquireWriteLock(path) {
+			for _, locked := range paths[:i] {
+				self.releaseWriteLock(locked)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+func (self *RootedRPCHandler) unlockTransfer(req *rpcRequest) {
+	for _, path := range self.transferPaths(req) {
+		self.releaseWriteLock(path)
+	}
+}
+
+// Removes what a failed transfer left at destination. When that failed
+// because the destination exists, it was created by someone else.
+func (self *RootedRPCHandler) removeFailedTransfer(destination string, err error) {
+	if !os.IsExist(err) {
+		self.fs.Remove(destination, true)
+	}
+}
+
+func (self *RootedRPCHandler) handleMove(req *rpcRequest, requestChannel chan []byte, responseChannel chan []byte) HttpError {
+	dropUntilDelimiter(requestChannel)
+	// Locked before looking at the destination, so it doesn't change until
+	// it's replaced
+	if !self.lockTransfer(req) {
+		return NewHttpError(http.StatusConflict, "Write already going on")
+	}
+	defer self.unlockTransfer(req)
+	source, destination, overwritten, httpErr := self.prepareTransfer(req)
+	if httpErr != nil {
+		return httpErr
+	}
+	move := func() error {
+		return self.moveVisible(source, destination)
+	}
+	var err error
+	if overwritten && !self.isDirectory(source) && !self.isDirectory(destination) {
+		// Renaming a file over another one replaces it atomically
+		self.keepVersion(destination)
+		err = move()
+	} else if overwritten {
+		err = self.replaceDestination(destination, move)
+	} else {
+		err = move()
+	}
+	if err != nil {
+		return fileError(err, "Could not move")
+	}
+	sendTransferResponse(responseChannel, overwritten)
+	return nil
+}
+
+// Copies a file or directory, a Depth: 0 header copies only the directory
+// itself and not its contents
+func (self *RootedRPCHandler) handleCopy(req *rpcRequest, requestChannel chan []byte, responseChannel chan []byte) HttpError {
+	dropUntilDelimiter(requestChannel)
+	// Locked before looking at the destination, so it doesn't change until
+	// it's replaced
+	if !self.lockTransfer(req) {
+		return NewHttpError(http.StatusConflict, "Write already going on")
+	}
+	defer self.unlockTransfer(req)
+	source, destination, overwritten, httpErr := self.prepareTransfer(req)
+	if httpErr != nil {
+		return httpErr
+	}
+	copySource := func() error {
+		err := self.copyVisible(source, destination, req.header.Get("Depth") != "0")
+		if err != nil {
+			self.removeFailedTransfer(destination, err)
+		}
+		return err
+	}
+	var err error
+	if overwritten {
+		err = self.replaceDestination(destination, copySource)
+	} else {
+		err = copySource()
+	}
+	if err != nil {
+		return fileError(err, "Could not copy")
+	}
+	sendTransferResponse(responseChannel, overwritten)
+	return nil
+}
+
+// Copies like FileSystem.Copy, leaving out paths hidden by the rules so they
+// don't show up under the destination
+func (self *RootedRPCHandler) copyVisible(source string, destination string, recursive bool) error {
+	if !recursive || !self.isDirectory(source) {
+		return self.fs.Copy(source, destination, recursive)
+	}
+	if err := self.fs.Copy(source, destination, false); err != nil {
+		return err
+	}
+	files, err := self.fs.ReadDir(source)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		path := filepath.Join(source, f.Name())
+		if self.isHidden(path, f.IsDir()) {
+			continue
+		}
+		if err := self.copyVisible(path, filepath.Join(destination, f.Name()), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Renames, unless the source is a directory with hidden paths in it. Those
+// stay where they are, everything else is copied and removed.
+func (self *RootedRPCHandler) moveVisible(source string, destination string) error {
+	if !self.isDirectory(source) || !self.containsHidden(source) {
+		return self.fs.Rename(source, destination)
+	}
+	if err := self.copyVisible(source, destination, true); err != nil {
+		self.removeFailedTransfer(destination, err)
+		return err
+	}
+	return self.removeVisible(source)
+}
+
+func (self *RootedRPCHandler) containsHidden(dirPath string) bool {
+	files, _ := self.fs.ReadDir(dirPath)
+	for _, f := range files {
+		path := filepath.Join(dirPath, f.Name())
+		if self.isHidden(path, f.IsDir()) || (f.IsDir() && self.containsHidden(path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes what copyVisible copies, directories that still hold hidden paths
+// are kept
+func (self *RootedRPCHandler) removeVisible(absPath string) error {
+	if !self.isDirectory(absPath) {
+		return self.fs.Remove(absPath, false)
+	}
+	files, err := self.fs.ReadDir(absPath)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		path := filepath.Join(absPath, f.Name())
+		if self.isHidden(path, f.IsDir()) {
+			continue
+		}
+		if err := self.removeVisible(path); err != nil {
+			return err
+		}
+	}
+	if err := self.fs.Remove(absPath, false); err != nil && !isNotEmpty(err) {
+		return err
+	}
+	return nil
+}
+
+func (self *RootedRPCHandler) isDirectory(absPath string) bool {
+	stat, err := self.fs.Lstat(absPath)
+	return err == nil && stat.IsDir()
+}
+
+// Keeps the contents of a file that is about to be replaced in the history
+func (self *RootedRPCHandler) keepVersion(absPath string) {
+	if err := self.saveVersion(absPath); err != nil {
+		fmt.Println("Could not save previous version of", absPath, err)
+	}
+}
+
+// Runs a MOVE or COPY over an existing destination, which is renamed aside
+// first and put back when the transfer fails. A replaced file is kept in the
+// history, a replaced directory in the trash when that is enabled. Directories
+// with hidden paths in them are not replaced, those would go with them.
+func (self *RootedRPCHandler) replaceDestination(destination string, transfer func() error) error {
+	isDir := self.isDirectory(destination)
+	if isDir && self.containsHidden(destination) {
+		return os.ErrPermission
+	}
+	self.keepVersion(destination)
+	aside := newTempPath(destination)
+	if err := self.fs.Rename(destination, aside); err != nil {
+		return err
+	}
+	if err := transfer(); err != nil {
+		if restoreErr := self.fs.Rename(aside, destination); restoreErr != nil {
+			fmt.Println("Could not put back", destination, "it is kept at", aside, restoreErr)
+		}
+		return err
+	}
+	if isDir && self.trash {
+		if err := self.moveToTrash(aside, destination, true); err == nil {
+			return nil
+		}
+	}
+	if err := self.fs.Remove(aside, true); err != nil {
+		fmt.Println("Could not remove replaced", destination, err)
+	}
+	return nil
+}
+
+func isNotEmpty(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	return err == syscall.ENOTEMPTY || err == syscall.EEXIST
+}
+
+// Creates a directory, with parents also any missing parent directories.
+// Without parents a missing parent is a 409 Conflict, as with WebDAV's MKCOL.
+func (self *RootedRPCHandler) makeDirectory(dirPath string, parents bool) HttpError {
+	if _, err := self.fs.Lstat(dirPath); err == nil {
+		return NewHttpError(http.StatusMethodNotAllowed, "Already exists")
+	}
+	if err := self.fs.Mkdir(dirPath, parents); err != nil {
+		if os.IsNotExist(err) {
+			return NewHttpError(http.StatusConflict, "Parent directory does not exist")
+		}
+		return fileError(err, "Could not create directory")
+	}
+	return nil
+}
+
+func sendCreated(responseChannel chan []byte) {
+	responseChannel <- statusCodeBuffer(http.StatusCreated)
+	responseChannel <- headerBuffer(map[string]string{"Content-Type": "text/plain"})
+	responseChannel <- []byte("OK")
+}
+
+func (self *RootedRPCHandler) handleMkcol(req *rpcRequest, requestChannel chan []byte, responseChannel chan []byte) HttpError {
+	dropUntilDelimiter(requestChannel)
+	dirPath, httpErr := self.resolvePath(req.path)
+	if httpErr != nil {
+		return httpErr
+	}
+	if httpErr := self.makeDirectory(dirPath, false); httpErr != nil {
+		return httpErr
+	}
+	sendCreated(responseChannel)
+	return nil
+}
+
+// Renames, falling back to copy and delete across file systems
+func moveTree(source string, destination string) error {
+	err := os.Rename(source, destination)
+	if _, ok := err.(*os.LinkError); ok {
+		if err := copyTree(source, destination, true); err != nil {
+			// Leave a destination alone that was there before
+			if !os.IsExist(err) {
+				os.RemoveAll(destination)
+			}
+			return err
+		}
+		return os.RemoveAll(source)
+	}
+	return err
+}
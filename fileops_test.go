@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestOverwriteKeepsReplaced(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "old"), 0755)
+	os.MkdirAll(filepath.Join(root, "new"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "old/keep.txt"), []byte("old dir"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "new/b.txt"), []byte("new dir"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "a.txt"), []byte("replaced"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "b.txt"), []byte("moved"), 0644)
+	handler := NewRootedRPCHandler(root, ClientOptions{
+		Trash:           true,
+		HistoryVersions: 5,
+		HistoryDir:      t.TempDir(),
+	})
+
+	if status, _ := testRequest(handler, "MOVE /b.txt", "Destination: /a.txt", ""); status != 204 {
+		t.Fatalf("MOVE over a file failed with %d", status)
+	}
+	if _, body := testRequest(handler, "POST /a.txt", "", "action=history-list"); body == "[]\n" {
+		t.Errorf("Replaced file not in the history")
+	}
+	if status, _ := testRequest(handler, "MOVE /new", "Destination: /old", ""); status != 204 {
+		t.Fatalf("MOVE over a directory failed with %d", status)
+	}
+	if _, body := testRequest(handler, "GET /old/b.txt", "", ""); body != "new dir" {
+		t.Errorf("Unexpected moved directory: %q", body)
+	}
+	_, body := testRequest(handler, "POST /", "", "action=trash-list")
+	var entries []TrashEntry
+	json.Unmarshal([]byte(body), &entries)
+	if len(entries) != 1 || entries[0].Path != "/old" {
+		t.Fatalf("Replaced directory not in the trash: %s", body)
+	}
+	testRequest(handler, "DELETE /old?recursive=true&permanent=true", "", "")
+	if status, _ := testRequest(handler, "POST /", "", "action=trash-restore&id="+entries[0].Id); status != 200 {
+		t.Errorf("Could not restore replaced directory: %d", status)
+	}
+	if _, body := testRequest(handler, "GET /old/keep.txt", "", ""); body != "old dir" {
+		t.Errorf("Unexpected restored directory: %q", body)
+	}
+}
+
+// Another program creates the destination just before it is copied to
+type racingFileSystem struct {
+	FileSystem
+}
+
+func (fs racingFileSystem) Copy(source string, destination string, recursive bool) error {
+	fs.WriteFile(destination, strings.NewReader("theirs"))
+	return fs.FileSystem.Copy(source, destination, recursive)
+}
+
+func TestFailedCopyKeepsOthersDestination(t *testing.T) {
+	root := filepath.FromSlash("/project")
+	fs := newMemoryFileSystem(root)
+	fs.WriteFile(filepath.Join(root, "a.txt"), strings.NewReader("ours"))
+	handler := NewRootedRPCHandler(root, ClientOptions{FileSystem: racingFileSystem{fs}})
+
+	if status, _ := testRequest(handler, "COPY /a.txt", "Destination: /b.txt", ""); status < 400 {
+		t.Fatalf("COPY onto a created destination succeeded with %d", status)
+	}
+	if data, _ := readFile(fs, filepath.Join(root, "b.txt")); string(data) != "theirs" {
+		t.Errorf("Destination created by someone else removed: %q", data)
+	}
+	if status, _ := testRequest(handler, "COPY /a.txt", "Destination: /a.txt", ""); status != 403 {
+		t.Errorf("COPY onto itself gave %d", status)
+	}
+}
+
+func TestRestoreOverwriteKeepsCurrent(t *testing.T) {
+	root := t.TempDir()
+	ioutil.WriteFile(filepath.Join(root, "a.txt"), []byte("deleted"), 0644)
+	handler := NewRootedRPCHandler(root, ClientOptions{Trash: true})
+	testRequest(handler, "DELETE /a.txt", "", "")
+	ioutil.WriteFile(filepath.Join(root, "a.txt"), []byte("current"), 0644)
+
+	var entries []TrashEntry
+	_, body := testRequest(handler, "POST /", "", "action=trash-list")
+	json.Unmarshal([]byte(body), &entries)
+	if len(entries) != 1 {
+		t.Fatalf("Unexpected trash: %s", body)
+	}
+	if status, _ := testRequest(handler, "POST /", "", "action=trash-restore&overwrite=true&id="+entries[0].Id); status != 200 {
+		t.Fatalf("Restore failed with %d", status)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(root, "a.txt")); string(data) != "deleted" {
+		t.Errorf("Unexpected restored file: %q", data)
+	}
+	_, body = testRequest(handler, "POST /", "", "action=trash-list")
+	json.Unmarshal([]byte(body), &entries)
+	if len(entries) != 1 || entries[0].Path != "/a.txt" {
+		t.Fatalf("Replaced file not in the trash: %s", body)
+	}
+	testRequest(handler, "POST /", "", "action=trash-restore&overwrite=true&id="+entries[0].Id)
+	if data, _ := ioutil.ReadFile(filepath.Join(root, "a.txt")); string(data) != "current" {
+		t.Errorf("Replaced file not restored: %q", data)
+	}
+}
+
+func TestMkcolAndRecursiveDelete(t *testing.T) {
+	root := t.TempDir()
+	handler := NewRootedRPCHandler(root, ClientOptions{})
+
+	if status, _ := testRequest(handler, "MKCOL /src", "", ""); status != 201 {
+		t.Fatalf("MKCOL failed with %d", status)
+	}
+	if status, _ := testRequest(handler, "MKCOL /src", "", ""); status != 405 {
+		t.Errorf("MKCOL of an existing directory gave %d", status)
+	}
+	if status, _ := testRequest(handler, "MKCOL /lib/sub", "", ""); status != 409 {
+		t.Errorf("MKCOL without parent gave %d", status)
+	}
+	if status, _ := testRequest(handler, "POST /lib/sub", "", "action=mkdir&parents=true"); status != 201 {
+		t.Errorf("mkdir with parents failed with %d", status)
+	}
+	if stat, err := os.Stat(filepath.Join(root, "lib/sub")); err != nil || !stat.IsDir() {
+		t.Errorf("Directory not created: %v", err)
+	}
+
+	ioutil.WriteFile(filepath.Join(root, "src/a.txt"), []byte("a"), 0644)
+	if status, _ := testRequest(handler, "DELETE /missing", "", ""); status != 404 {
+		t.Errorf("DELETE of a missing path gave %d", status)
+	}
+	if status, _ := testRequest(handler, "DELETE /src", "", ""); status != 409 {
+		t.Errorf("DELETE of a non-empty directory gave %d", status)
+	}
+	if _, err := os.Stat(filepath.Join(root, "src/a.txt")); err != nil {
+		t.Fatalf("File deleted without recursive=true: %v", err)
+	}
+	if status, _ := testRequest(handler, "DELETE /src?recursive=true", "", ""); status != 200 {
+		t.Errorf("Recursive DELETE failed with %d", status)
+	}
+	if _, err := os.Stat(filepath.Join(root, "src")); !os.IsNotExist(err) {
+		t.Errorf("Directory left after recursive DELETE: %v", err)
+	}
+	if status, _ := testRequest(handler, "DELETE /lib/sub", "", ""); status != 200 {
+		t.Errorf("DELETE of an empty directory failed with %d", status)
+	}
+
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		return
+	}
+	os.Chmod(filepath.Join(root, "lib"), 0555)
+	defer os.Chmod(filepath.Join(root, "lib"), 0755)
+	if status, _ := testRequest(handler, "MKCOL /lib/sub", "", ""); status != 403 {
+		t.Errorf("MKCOL without permission gave %d", status)
+	}
+}
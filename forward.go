@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Websockets under /fwd/ using this subprotocol are relayed as raw TCP
+// connections instead of being proxied as HTTP
+const FORWARD_TCP_PROTOCOL = "zedrem-tcp"
+
+// Values of the repeatable -forward flag
+type portList []int
+
+func (ports *portList) String() string {
+	return fmt.Sprint(*ports)
+}
+
+func (ports *portList) Set(value string) error {
+	port, err := strconv.Atoi(value)
+	if err != nil || port <= 0 || port > 65535 {
+		return errors.New("Invalid port: " + value)
+	}
+	*ports = append(*ports, port)
+	return nil
+}
+
+// Connects to a local port listed with -forward, relaying data in both
+// directions as stream messages
+func (self *RootedRPCHandler) handleConnect(req *rpcRequest, requestChannel chan []byte, responseChannel chan []byte) HttpError {
+	dropUntilDelimiter(requestChannel)
+	port, err := strconv.Atoi(req.path)
+	if err != nil || !self.forwardPorts[port] {
+		return NewHttpError(http.StatusForbidden, "Port not forwarded: "+req.path)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort("localhost", req.path))
+	if err != nil {
+		return NewHttpError(http.StatusBadGateway, "Could not connect: "+err.Error())
+	}
+	defer conn.Close()
+
+	responseChannel <- statusCodeBuffer(200)
+	responseChannel <- headerBuffer(map[string]string{"Content-Type": "application/octet-stream"})
+	closed := make(chan bool)
+	go func() {
+		for {
+			buffer := make([]byte, BUFFER_SIZE-1)
+			n, err := conn.Read(buffer)
+			if n > 0 {
+				responseChannel <- streamMessage(STREAM_DATA, buffer[:n])
+			}
+			if err != nil {
+				break
+			}
+		}
+		responseChannel <- streamMessage(STREAM_END, nil)
+		close(closed)
+	}()
+	for {
+		buffer, ok := <-requestChannel
+		if !ok || IsCancel(buffer) {
+			break
+		}
+		if len(buffer) > 0 && buffer[0] == STREAM_DATA {
+			if _, err := conn.Write(buffer[1:]); err != nil {
+				break
+			}
+		}
+	}
+	conn.Close()
+	<-closed
+	return nil
+}
+
+// net.Conn on the relay for a connection to a forwarded port on the client
+type streamConn struct {
+	req       *ClientRequest
+	data      chan []byte
+	pending   []byte
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+func dialForwardedPort(id string, port string) (net.Conn, error) {
+	req, err := OpenClientStream(id, "CONNECT /"+port)
+	if err != nil {
+		return nil, err
+	}
+	conn := &streamConn{
+		req:    req,
+		data:   make(chan []byte),
+		closed: make(chan bool),
+	}
+	go conn.pump()
+	return conn, nil
+}
+
+// Reads messages from the client until the end of the response
+func (c *streamConn) pump() {
+	defer close(c.data)
+	for {
+		buffer, ok := <-c.req.ch
+		if !ok || IsDelimiter(buffer) {
+			c.req.finish()
+			return
+		}
+		if len(buffer) == 0 {
+			continue
+		}
+		switch buffer[0] {
+		case STREAM_END:
+			c.req.cancel()
+		case STREAM_DATA:
+			select {
+			case c.data <- buffer[1:]:
+			case <-c.closed:
+			}
+		}
+	}
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		select {
+		case buffer, ok := <-c.data:
+			if !ok {
+				return 0, io.EOF
+			}
+			c.pending = buffer
+		case <-c.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	for written := 0; written < len(p); written += BUFFER_SIZE - 1 {
+		end := written + BUFFER_SIZE - 1
+		if end > len(p) {
+			end = len(p)
+		}
+		if !c.req.send(streamMessage(STREAM_DATA, p[written:end])) {
+			return written, io.ErrClosedPipe
+		}
+	}
+	return len(p), nil
+}
+
+func (c *streamConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.req.cancel()
+	})
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr                { return streamAddr{} }
+func (c *streamConn) RemoteAddr() net.Addr               { return streamAddr{} }
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "zedrem" }
+func (streamAddr) String() string  { return "zedrem" }
+
+// Serves /fwd/<id>/<port>/<path>, proxying HTTP to the forwarded port on the
+// client. Like /fs/, access requires knowing the session id.
+type ForwardHandler struct {
+}
+
+func (self *ForwardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer quietPanicRecover()
+	parts := strings.SplitN(r.URL.Path, "/", 3)
+	if len(parts) < 2 {
+		http.Error(w, "Expected /fwd/<id>/<port>/", http.StatusNotFound)
+		return
+	}
+	id, port := parts[0], parts[1]
+	if _, err := strconv.Atoi(port); err != nil {
+		http.Error(w, "Invalid port", http.StatusNotFound)
+		return
+	}
+	path := "/"
+	if len(parts) == 3 {
+		path += parts[2]
+	}
+	if websocketProtocolRequested(r, FORWARD_TCP_PROTOCOL) {
+		// The websocket handshake needs the full path for its Location
+		r.URL.Path = "/fwd/" + r.URL.Path
+		websocket.Server{
+			Handshake: func(config *websocket.Config, r *http.Request) error {
+				config.Protocol = []string{FORWARD_TCP_PROTOCOL}
+				return nil
+			},
+			Handler: func(ws *websocket.Conn) {
+				relayTCP(ws, id, port)
+			},
+		}.ServeHTTP(w, r)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = "localhost:" + port
+			r.URL.Path = path
+			r.URL.RawPath = ""
+			r.Host = r.URL.Host
+			r.Header.Set("X-Forwarded-Prefix", "/fwd/"+id+"/"+port)
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialForwardedPort(id, port)
+			},
+			// Every connection holds on to a request id
+			DisableKeepAlives: true,
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+func websocketProtocolRequested(r *http.Request, protocol string) bool {
+	for _, value := range r.Header["Sec-Websocket-Protocol"] {
+		for _, p := range strings.Split(value, ",") {
+			if strings.TrimSpace(p) == protocol {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Relays binary websocket messages to and from a forwarded port
+func relayTCP(ws *websocket.Conn, id string, port string) {
+	defer ws.Close()
+	conn, err := dialForwardedPort(id, port)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	ws.PayloadType = websocket.BinaryFrame
+	go func() {
+		io.Copy(conn, ws)
+		conn.Close()
+	}()
+	io.Copy(ws, conn)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"golang.org/x/net/websocket"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestForwardPort(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path + " " + r.Header.Get("X-Forwarded-Prefix")))
+	}))
+	defer app.Close()
+	echo, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	_, appPort, _ := net.SplitHostPort(strings.TrimPrefix(app.URL, "http://"))
+	_, echoPort, _ := net.SplitHostPort(echo.Addr().String())
+	forward := []int{}
+	for _, port := range []string{appPort, echoPort} {
+		p, _ := strconv.Atoi(port)
+		forward = append(forward, p)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/fwd/", http.StripPrefix("/fwd/", &ForwardHandler{}))
+	mux.Handle("/clientsocket", websocket.Handler(socketServer))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	id := newSessionId()
+	ws := connectTestClient(t, server, id, NewRootedRPCHandler(t.TempDir(), ClientOptions{Forward: forward}))
+	defer ws.Close()
+	waitForConnection(t, id, true)
+
+	resp, err := http.Get(server.URL + "/fwd/" + id + "/" + appPort + "/page?q=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "/page /fwd/"+id+"/"+appPort {
+		t.Errorf("Unexpected proxied response: %d %q", resp.StatusCode, body)
+	}
+
+	config, _ := websocket.NewConfig("ws"+strings.TrimPrefix(server.URL, "http")+"/fwd/"+id+"/"+echoPort+"/", server.URL)
+	config.Protocol = []string{FORWARD_TCP_PROTOCOL}
+	tcp, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp.PayloadType = websocket.BinaryFrame
+	tcp.Write([]byte("ping"))
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(tcp, reply); err != nil || string(reply) != "ping" {
+		t.Errorf("Unexpected relayed reply: %q %v", reply, err)
+	}
+	tcp.Close()
+
+	// Only ports listed with -forward are reachable
+	closed, _ := net.Listen("tcp", "localhost:0")
+	_, closedPort, _ := net.SplitHostPort(closed.Addr().String())
+	defer closed.Close()
+	resp, err = http.Get(server.URL + "/fwd/" + id + "/" + closedPort + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == 200 {
+		t.Errorf("Port that isn't forwarded reached")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Where RootedRPCHandler reads and writes files. Paths are absolute paths
+// below the root, as returned by resolvePath. Errors are *os.PathError where
+// possible, so fileError can map them to a status.
+type FileSystem interface {
+	Stat(absPath string) (os.FileInfo, error)
+	Lstat(absPath string) (os.FileInfo, error)
+	ReadDir(absPath string) ([]os.FileInfo, error)
+	Readlink(absPath string) (string, error)
+	EvalSymlinks(absPath string) (string, error)
+	Open(absPath string) (io.ReadCloser, error)
+	// Replaces the contents of a file with everything read from r, creating it
+	// and its parent directories if needed. Readers see either the old or the
+	// new contents, never a partial write.
+	WriteFile(absPath string, r io.Reader) error
+	Mkdir(absPath string, parents bool) error
+	Remove(absPath string, recursive bool) error
+	Rename(source string, destination string) error
+	Copy(source string, destination string, recursive bool) error
+	// Emits events for all changes below absPath until done is closed, paths
+	// in events are absolute
+	Watch(absPath string, skip watchFilter, done chan bool) (chan WatchEvent, error)
+}
+
+// The local file system
+type osFileSystem struct {
+}
+
+func (osFileSystem) Stat(absPath string) (os.FileInfo, error) {
+	return os.Stat(absPath)
+}
+
+func (osFileSystem) Lstat(absPath string) (os.FileInfo, error) {
+	return os.Lstat(absPath)
+}
+
+func (osFileSystem) ReadDir(absPath string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(absPath)
+}
+
+func (osFileSystem) Readlink(absPath string) (string, error) {
+	return os.Readlink(absPath)
+}
+
+func (osFileSystem) EvalSymlinks(absPath string) (string, error) {
+	return filepath.EvalSymlinks(absPath)
+}
+
+func (osFileSystem) Open(absPath string) (io.ReadCloser, error) {
+	return os.Open(absPath)
+}
+
+// Writes to a temporary file next to absPath first, to avoid corrupted files
+func (osFileSystem) WriteFile(absPath string, r io.Reader) error {
+	os.MkdirAll(filepath.Dir(absPath), 0777)
+	tempPath := newTempPath(absPath)
+	defer os.Remove(tempPath)
+	f, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	f.Sync()
+	f.Close()
+	return replaceFile(tempPath, absPath)
+}
+
+func (osFileSystem) Mkdir(absPath string, parents bool) error {
+	if parents {
+		return os.MkdirAll(absPath, 0777)
+	}
+	return os.Mkdir(absPath, 0777)
+}
+
+func (osFileSystem) Remove(absPath string, recursive bool) error {
+	if recursive {
+		return os.RemoveAll(absPath)
+	}
+	return os.Remove(absPath)
+}
+
+func (osFileSystem) Rename(source string, destination string) error {
+	return moveTree(source, destination)
+}
+
+func (osFileSystem) Copy(source string, destination string, recursive bool) error {
+	return copyTree(source, destination, recursive)
+}
+
+func (osFileSystem) Watch(absPath string, skip watchFilter, done chan bool) (chan WatchEvent, error) {
+	return watchTree(absPath, skip, done)
+}
+
+func readFile(fs FileSystem, absPath string) ([]byte, error) {
+	f, err := fs.Open(absPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// Write operations for snapshots that can't change, to be embedded
+type readOnlyFileSystem struct {
+}
+
+func (readOnlyFileSystem) WriteFile(absPath string, r io.Reader) error {
+	return &os.PathError{Op: "write", Path: absPath, Err: os.ErrPermission}
+}
+
+func (readOnlyFileSystem) Mkdir(absPath string, parents bool) error {
+	return &os.PathError{Op: "mkdir", Path: absPath, Err: os.ErrPermission}
+}
+
+func (readOnlyFileSystem) Remove(absPath string, recursive bool) error {
+	return &os.PathError{Op: "remove", Path: absPath, Err: os.ErrPermission}
+}
+
+func (readOnlyFileSystem) Rename(source string, destination string) error {
+	return &os.PathError{Op: "rename", Path: source, Err: os.ErrPermission}
+}
+
+func (readOnlyFileSystem) Copy(source string, destination string, recursive bool) error {
+	return &os.PathError{Op: "copy", Path: destination, Err: os.ErrPermission}
+}
+
+// Nothing ever changes, so the events just end when done is closed
+func (readOnlyFileSystem) Watch(absPath string, skip watchFilter, done chan bool) (chan WatchEvent, error) {
+	events := make(chan WatchEvent)
+	go func() {
+		<-done
+		close(events)
+	}()
+	return events, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Runs a single request through the handler, returning the status and body
+func testRequest(handler RPCHandler, requestLine string, headers string, body string) (int, string) {
+	status, _, response := testRequestHeaders(handler, requestLine, headers, body)
+	return status, response
+}
+
+// Like testRequest, also returning the response headers as sent
+func testRequestHeaders(handler RPCHandler, requestLine string, headers string, body string) (int, string, string) {
+	requestChannel := make(chan []byte, 10)
+	responseChannel := make(chan []byte, 1000)
+	closeChannel := make(chan bool, 1)
+	requestChannel <- []byte(requestLine)
+	requestChannel <- []byte(headers)
+	if body != "" {
+		requestChannel <- []byte(body)
+	}
+	requestChannel <- DELIMITERBUFFER
+	handler.handleRequest(requestChannel, responseChannel, closeChannel)
+	close(responseChannel)
+	status := BytesToInt(<-responseChannel)
+	responseHeaders := string(<-responseChannel)
+	var response []byte
+	for buffer := range responseChannel {
+		if IsDelimiter(buffer) {
+			break
+		}
+		response = append(response, buffer...)
+	}
+	return status, responseHeaders, string(response)
+}
+
+func TestMemoryFileSystem(t *testing.T) {
+	root := filepath.FromSlash("/project")
+	fs := newMemoryFileSystem(root)
+	handler := NewRootedRPCHandler(root, ClientOptions{FileSystem: fs})
+
+	if status, _ := testRequest(handler, "PUT /src/a.txt", "", "hello\n"); status != 200 {
+		t.Fatalf("PUT failed with %d", status)
+	}
+	if status, body := testRequest(handler, "GET /src/a.txt", "", ""); status != 200 || body != "hello\n" {
+		t.Errorf("Unexpected GET: %d %q", status, body)
+	}
+	if status, body := testRequest(handler, "GET /src", "", ""); status != 200 || body != "a.txt\n" {
+		t.Errorf("Unexpected listing: %d %q", status, body)
+	}
+	if status, _ := testRequest(handler, "MOVE /src/a.txt", "Destination: /src/b.txt", ""); status != 201 && status != 204 {
+		t.Errorf("MOVE failed with %d", status)
+	}
+	if status, _ := testRequest(handler, "GET /src/a.txt", "", ""); status != 404 {
+		t.Errorf("Moved file still there: %d", status)
+	}
+	if status, body := testRequest(handler, "POST /", "", "action=filelist"); status != 200 || body != "/src/b.txt\n" {
+		t.Errorf("Unexpected filelist: %d %q", status, body)
+	}
+	if status, _ := testRequest(handler, "DELETE /src", "", ""); status != 409 {
+		t.Errorf("Deleted a non-empty directory: %d", status)
+	}
+	if status, _ := testRequest(handler, "DELETE /src?recursive=true", "", ""); status != 200 {
+		t.Errorf("DELETE failed with %d", status)
+	}
+	if files, _ := fs.ReadDir(root); len(files) != 0 {
+		t.Errorf("Files left after delete: %d", len(files))
+	}
+	if status, _ := testRequest(handler, "POST /", "", "action=trash-list"); status != 501 {
+		t.Errorf("Local only action allowed: %d", status)
+	}
+}
+
+func TestArchiveFileSystem(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "project.zip")
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := zip.NewWriter(f)
+	for _, name := range []string{"src/a.go", "../escape.txt"} {
+		w, _ := archive.Create(name)
+		w.Write([]byte("contents of " + name))
+	}
+	archive.Close()
+	f.Close()
+
+	handler := NewRootedRPCHandler(archivePath, ClientOptions{})
+	if status, body := testRequest(handler, "GET /src/a.go", "", ""); status != 200 || body != "contents of src/a.go" {
+		t.Errorf("Unexpected GET: %d %q", status, body)
+	}
+	if status, body := testRequest(handler, "POST /", "", "action=filelist"); status != 200 || strings.Count(body, "\n") != 2 || !strings.Contains(body, "/escape.txt\n") {
+		t.Errorf("Unexpected filelist: %d %q", status, body)
+	}
+	if status, _ := testRequest(handler, "PUT /src/a.go", "", "changed"); status != 403 {
+		t.Errorf("Archive written: %d", status)
+	}
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	root := filepath.FromSlash("/project")
+	fs := newMemoryFileSystem(root)
+	fs.WriteFile(filepath.Join(root, "src/a.txt"), strings.NewReader("hello\n"))
+	handler := NewRootedRPCHandler(root, ClientOptions{FileSystem: fs, ReadOnly: true})
+
+	status, headers, _ := testRequestHeaders(handler, "HEAD /src/a.txt", "", "")
+	if status != 200 || !strings.Contains(headers, "X-ReadOnly: true") {
+		t.Errorf("Read-only mode not advertised: %d %q", status, headers)
+	}
+	if status, body := testRequest(handler, "GET /src/a.txt", "", ""); status != 200 || body != "hello\n" {
+		t.Errorf("Unexpected GET: %d %q", status, body)
+	}
+	if status, body := testRequest(handler, "POST /", "", "action=filelist"); status != 200 || body != "/src/a.txt\n" {
+		t.Errorf("Unexpected filelist: %d %q", status, body)
+	}
+	for _, request := range [][]string{
+		{"PUT /src/a.txt", "", "changed"},
+		{"PUT /src/b.txt", "", "new"},
+		{"DELETE /src/a.txt", "", ""},
+		{"DELETE /src?recursive=true", "", ""},
+		{"MKCOL /lib", "", ""},
+		{"MOVE /src/a.txt", "Destination: /src/b.txt", ""},
+		{"COPY /src/a.txt", "Destination: /src/b.txt", ""},
+		{"POST /lib", "", "action=mkdir"},
+		{"POST /src/a.txt", "", "action=history-restore&id=1"},
+	} {
+		if status, _ := testRequest(handler, request[0], request[1], request[2]); status != 403 {
+			t.Errorf("%s allowed in read-only mode: %d", request[0], status)
+		}
+	}
+	if data, _ := readFile(fs, filepath.Join(root, "src/a.txt")); string(data) != "hello\n" {
+		t.Errorf("File changed in read-only mode: %q", data)
+	}
+	if files, _ := fs.ReadDir(root); len(files) != 1 {
+		t.Errorf("Files created in read-only mode: %d", len(files))
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const GIT_DEFAULT_LOG_ENTRIES = 50
+
+type GitStatusEntry struct {
+	Path     string `json:"path"`
+	From     string `json:"from,omitempty"`
+	Index    string `json:"index"`
+	Worktree string `json:"worktree"`
+}
+
+type GitDiffHunk struct {
+	OldStart int      `json:"oldStart"`
+	OldLines int      `json:"oldLines"`
+	NewStart int      `json:"newStart"`
+	NewLines int      `json:"newLines"`
+	Lines    []string `json:"lines"`
+}
+
+type GitDiffFile struct {
+	Path  string        `json:"path"`
+	Hunks []GitDiffHunk `json:"hunks"`
+}
+
+type GitBlameLine struct {
+	Line    int       `json:"line"`
+	Commit  string    `json:"commit"`
+	Author  string    `json:"author"`
+	Time    time.Time `json:"time"`
+	Summary string    `json:"summary"`
+}
+
+type GitCommit struct {
+	Commit  string    `json:"commit"`
+	Author  string    `json:"author"`
+	Email   string    `json:"email"`
+	Time    time.Time `json:"time"`
+	Subject string    `json:"subject"`
+}
+
+// Git in dir, ignoring the settings of the repository that make it run
+// commands (fsmonitor, signature checks and filters; textconv and external
+// diffs are turned off per command) and without optional locks, so status
+// doesn't write the index.
+func gitCommand(dir string, args ...string) *exec.Cmd {
+	safeArgs := []string{"-c", "core.fsmonitor=false", "-c", "log.showSignature=false"}
+	filters := exec.Command("git", "config", "--name-only", "--get-regexp", `^filter\.`)
+	filters.Dir = dir
+	output, _ := filters.Output()
+	for _, name := range strings.Fields(string(output)) {
+		driver := name[:strings.LastIndex(name, ".")]
+		safeArgs = append(safeArgs, "-c", driver+".clean=", "-c", driver+".smudge=", "-c", driver+".process=", "-c", driver+".required=false")
+	}
+	cmd := exec.Command("git", append(safeArgs, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_OPTIONAL_LOCKS=0")
+	return cmd
+}
+
+// Runs git in the root, returning its output or its error message
+func (self *RootedRPCHandler) runGit(args ...string) ([]byte, HttpError) {
+	cmd := gitCommand(self.rootPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return nil, NewHttpError(http.StatusNotImplemented, "Could not run git: "+err.Error())
+		}
+		return nil, NewHttpError(http.StatusBadRequest, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// Git path spec for absPath, relative to the root
+func (self *RootedRPCHandler) gitPath(absPath string) string {
+	if absPath == self.rootPath {
+		return "."
+	}
+	return self.relativePath(absPath)
+}
+
+// Revisions starting with a dash would be taken as options
+func validRevision(rev string) bool {
+	return rev != "" && !strings.HasPrefix(rev, "-")
+}
+
+func (self *RootedRPCHandler) gitStatus(absPath string) ([]GitStatusEntry, HttpError) {
+	// Porcelain output is relative to the top level, not the root
+	prefix, httpErr := self.runGit("rev-parse", "--show-prefix")
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	output, httpErr := self.runGit("status", "--porcelain", "-z", "--untracked-files=all", "--", self.gitPath(absPath))
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	toRoot := func(path string) string {
+		return "/" + strings.TrimPrefix(path, strings.TrimSpace(string(prefix)))
+	}
+	entries := make([]GitStatusEntry, 0)
+	records := strings.Split(string(output), "\x00")
+	for i := 0; i < len(records); i++ {
+		record := records[i]
+		if len(record) < 4 {
+			continue
+		}
+		entry := GitStatusEntry{
+			Path:     toRoot(record[3:]),
+			Index:    record[0:1],
+			Worktree: record[1:2],
+		}
+		// Renames and copies are followed by the original path
+		if (record[0] == 'R' || record[0] == 'C') && i+1 < len(records) {
+			i++
+			entry.From = toRoot(records[i])
+		}
+		if !self.isHidden(filepath.Join(self.rootPath, filepath.FromSlash(entry.Path)), false) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// Parses unified diff output into files and hunks
+func parseGitDiff(output []byte) []GitDiffFile {
+	files := make([]GitDiffFile, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, BUFFER_SIZE), 1024*1024)
+	var file *GitDiffFile
+	var hunk *GitDiffHunk
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			// Renames and mode changes come without +++ line
+			path := line[strings.LastIndex(line, " b/")+3:]
+			files = append(files, GitDiffFile{Path: path, Hunks: make([]GitDiffHunk, 0)})
+			file = &files[len(files)-1]
+			hunk = nil
+		case file != nil && hunk == nil && strings.HasPrefix(line, "+++ b/"):
+			file.Path = strings.TrimPrefix(line, "+++ b/")
+		case file != nil && strings.HasPrefix(line, "@@"):
+			var h GitDiffHunk
+			var err error
+			h.OldStart, h.OldLines, h.NewStart, h.NewLines, err = parseHunkHeader(line)
+			if err != nil {
+				hunk = nil
+				continue
+			}
+			h.Lines = make([]string, 0)
+			file.Hunks = append(file.Hunks, h)
+			hunk = &file.Hunks[len(file.Hunks)-1]
+		case hunk != nil:
+			hunk.Lines = append(hunk.Lines, line)
+		}
+	}
+	return files
+}
+
+// Parses the output of git blame --porcelain
+func parseGitBlame(output []byte) []GitBlameLine {
+	lines := make([]GitBlameLine, 0)
+	commits := make(map[string]*GitBlameLine)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, BUFFER_SIZE), 1024*1024)
+	var current *GitBlameLine
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "\t") {
+			if current != nil {
+				lines = append(lines, *current)
+			}
+			current = nil
+			continue
+		}
+		if current == nil {
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				continue
+			}
+			lineNumber, _ := strconv.Atoi(fields[2])
+			info := commits[fields[0]]
+			if info == nil {
+				info = &GitBlameLine{Commit: fields[0]}
+				commits[fields[0]] = info
+			}
+			current = &GitBlameLine{Line: lineNumber, Commit: info.Commit}
+			continue
+		}
+		info := commits[current.Commit]
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) == 2 {
+			switch parts[0] {
+			case "author":
+				info.Author = parts[1]
+			case "author-time":
+				seconds, _ := strconv.ParseInt(parts[1], 10, 64)
+				info.Time = time.Unix(seconds, 0)
+			case "summary":
+				info.Summary = parts[1]
+			}
+		}
+	}
+	// Commit details are only given the first time a commit shows up
+	for i := range lines {
+		info := commits[lines[i].Commit]
+		lines[i].Author, lines[i].Time, lines[i].Summary = info.Author, info.Time, info.Summary
+	}
+	return lines
+}
+
+func parseGitLog(output []byte) []GitCommit {
+	commits := make([]GitCommit, 0)
+	for _, record := range strings.Split(string(output), "\x1e") {
+		fields := strings.Split(strings.TrimSpace(record), "\x00")
+		if len(fields) != 5 {
+			continue
+		}
+		seconds, _ := strconv.ParseInt(fields[3], 10, 64)
+		commits = append(commits, GitCommit{fields[0], fields[1], fields[2], time.Unix(seconds, 0), fields[4]})
+	}
+	return commits
+}
+
+// Drops the names hidden by the rules from the listing git show gives for a
+// directory, a header line and an empty line followed by one name per line
+func (self *RootedRPCHandler) filterGitTree(dirPath string, output []byte) []byte {
+	lines := strings.SplitAfter(string(output), "\n")
+	var filtered bytes.Buffer
+	for i, line := range lines {
+		name := strings.TrimSuffix(line, "\n")
+		if i >= 2 && name != "" {
+			isDir := strings.HasSuffix(name, "/")
+			if self.isHidden(filepath.Join(dirPath, strings.TrimSuffix(name, "/")), isDir) {
+				continue
+			}
+		}
+		filtered.WriteString(line)
+	}
+	return filtered.Bytes()
+}
+
+// Actions: git-status, git-diff (staged=true, rev), git-blame (rev), git-log
+// (rev, max) and git-show (rev), all for the path posted to. All but git-show,
+// which returns the file at rev, return JSON.
+func (self *RootedRPCHandler) handleGit(action string, absPath string, queryValues url.Values, responseChannel chan []byte) HttpError {
+	rev := queryValues.Get("rev")
+	if rev != "" && !validRevision(rev) {
+		return NewHttpError(http.StatusBadRequest, "Invalid revision")
+	}
+	path := self.gitPath(absPath)
+	var result interface{}
+	switch action {
+	case "git-status":
+		entries, httpErr := self.gitStatus(absPath)
+		if httpErr != nil {
+			return httpErr
+		}
+		result = entries
+	case "git-diff":
+		args := []string{"diff", "--no-color", "--no-ext-diff", "--no-textconv", "--relative"}
+		if queryValues.Get("staged") == "true" {
+			args = append(args, "--cached")
+		}
+		if rev != "" {
+			args = append(args, rev)
+		}
+		output, httpErr := self.runGit(append(args, "--", path)...)
+		if httpErr != nil {
+			return httpErr
+		}
+		files := make([]GitDiffFile, 0)
+		for _, file := range parseGitDiff(output) {
+			file.Path = "/" + strings.TrimPrefix(file.Path, "/")
+			if !self.isHidden(filepath.Join(self.rootPath, filepath.FromSlash(file.Path)), false) {
+				files = append(files, file)
+			}
+		}
+		result = files
+	case "git-blame":
+		args := []string{"blame", "--porcelain", "--no-textconv"}
+		if rev != "" {
+			args = append(args, rev)
+		}
+		output, httpErr := self.runGit(append(args, "--", path)...)
+		if httpErr != nil {
+			return httpErr
+		}
+		result = parseGitBlame(output)
+	case "git-log":
+		max, err := strconv.Atoi(queryValues.Get("max"))
+		if err != nil || max <= 0 {
+			max = GIT_DEFAULT_LOG_ENTRIES
+		}
+		args := []string{"log", "-n", strconv.Itoa(max), "--format=%H%x00%an%x00%ae%x00%at%x00%s%x1e"}
+		if rev != "" {
+			args = append(args, rev)
+		}
+		output, httpErr := self.runGit(append(args, "--", path)...)
+		if httpErr != nil {
+			return httpErr
+		}
+		result = parseGitLog(output)
+	case "git-show":
+		if rev == "" {
+			rev = "HEAD"
+		}
+		objectType, httpErr := self.runGit("cat-file", "-t", rev+":./"+path)
+		if httpErr != nil {
+			return httpErr
+		}
+		output, httpErr := self.runGit("show", "--no-textconv", rev+":./"+path)
+		if httpErr != nil {
+			return httpErr
+		}
+		if string(bytes.TrimSpace(objectType)) == "tree" {
+			output = self.filterGitTree(absPath, output)
+		}
+		mimeType := mime.TypeByExtension(filepath.Ext(absPath))
+		if mimeType == "" {
+			mimeType = "application/octet-stream"
+		}
+		responseChannel <- statusCodeBuffer(200)
+		responseChannel <- headerBuffer(map[string]string{"Content-Type": mimeType})
+		(&channelWriter{responseChannel}).Write(output)
+		return nil
+	default:
+		return NewHttpError(http.StatusNotImplemented, "No such action")
+	}
+	responseChannel <- statusCodeBuffer(200)
+	responseChannel <- headerBuffer(map[string]string{"Content-Type": "application/json"})
+	json.NewEncoder(&channelWriter{responseChannel}).Encode(result)
+	return nil
+}
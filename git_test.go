@@ -0,0 +1,195 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGitHidesExcludedFiles(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	root, err := ioutil.TempDir("", "zedrem-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = root
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v %s", args, err, output)
+		}
+	}
+	writeFiles := func(content string) {
+		for _, name := range []string{".env", "a.txt"} {
+			if err := ioutil.WriteFile(filepath.Join(root, name), []byte(content+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	git("init", "-q")
+	writeFiles("old")
+	git("add", ".")
+	git("commit", "-q", "-m", "init")
+	writeFiles("new")
+	handler := NewRootedRPCHandler(root, ClientOptions{Exclude: []string{".env"}})
+
+	status, body := testRequest(handler, "POST /", "", "action=git-diff")
+	if status != 200 || !strings.Contains(body, "/a.txt") {
+		t.Fatalf("Visible change not diffed: %d %s", status, body)
+	}
+	if strings.Contains(body, ".env") {
+		t.Errorf("Hidden change diffed: %s", body)
+	}
+	status, body = testRequest(handler, "POST /", "", "action=git-show")
+	if status != 200 || !strings.Contains(body, "a.txt") {
+		t.Fatalf("Tree not shown: %d %s", status, body)
+	}
+	if strings.Contains(body, ".env") {
+		t.Errorf("Hidden name shown: %s", body)
+	}
+}
+
+func TestGitRunsNoRepositoryCommands(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	root := t.TempDir()
+	marker := filepath.Join(t.TempDir(), "ran")
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = root
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v %s", args, err, output)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(root, "a.txt"), []byte("old\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "b.txt"), []byte("same\n"), 0644)
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "init")
+	// What a session peer could otherwise have written over the session
+	ioutil.WriteFile(filepath.Join(root, ".gitattributes"), []byte("*.txt filter=evil diff=evil\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "a.txt"), []byte("new\n"), 0644)
+	command := "touch " + marker + "; cat"
+	git("config", "core.fsmonitor", command)
+	git("config", "filter.evil.clean", command)
+	git("config", "filter.evil.required", "true")
+	git("config", "diff.evil.textconv", "sh -c '"+command+" \"$0\"'")
+	handler := NewRootedRPCHandler(root, ClientOptions{})
+
+	// Status would refresh the stat data of the touched file in the index
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(root, "b.txt"), later, later)
+	index, _ := ioutil.ReadFile(filepath.Join(root, ".git/index"))
+	readOnly := NewRootedRPCHandler(root, ClientOptions{ReadOnly: true})
+	if status, body := testRequest(readOnly, "POST /", "", "action=git-status"); status != 200 {
+		t.Errorf("git-status failed with %d: %s", status, body)
+	}
+	if after, _ := ioutil.ReadFile(filepath.Join(root, ".git/index")); string(after) != string(index) {
+		t.Errorf("git-status wrote the index in read-only mode")
+	}
+
+	for _, action := range []string{"git-status", "git-diff", "git-blame", "git-show"} {
+		path := "/a.txt"
+		if action == "git-status" || action == "git-diff" {
+			path = "/"
+		}
+		if status, body := testRequest(handler, "POST "+path, "", "action="+action); status != 200 {
+			t.Errorf("%s failed with %d: %s", action, status, body)
+		}
+		if _, err := os.Stat(marker); err == nil {
+			t.Fatalf("%s ran a command from the repository", action)
+		}
+	}
+
+	if status, _ := testRequest(handler, "PUT /.git/config", "", "[core]"); status != 403 {
+		t.Errorf("Wrote .git/config: %d", status)
+	}
+	if status, _ := testRequest(handler, "MOVE /a.txt", "Destination: /sub/.git/config", ""); status != 403 {
+		t.Errorf("Moved into .git: %d", status)
+	}
+	if status, _ := testRequest(handler, "POST /.git/hooks", "", "action=mkdir"); status != 403 {
+		t.Errorf("Created a directory in .git: %d", status)
+	}
+}
+
+func TestTrashNotUntracked(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	root := t.TempDir()
+	if output, err := exec.Command("git", "init", "-q", root).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v %s", err, output)
+	}
+	ioutil.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644)
+	handler := NewRootedRPCHandler(root, ClientOptions{Trash: true})
+
+	if status, _ := testRequest(handler, "DELETE /a.txt", "", ""); status != 200 {
+		t.Fatalf("DELETE failed with %d", status)
+	}
+	cmd := exec.Command("git", "status", "--porcelain", "--untracked-files=all")
+	cmd.Dir = root
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git status: %v %s", err, output)
+	}
+	if len(output) != 0 {
+		t.Errorf("Trash shows up in git status: %s", output)
+	}
+}
+
+func TestServeRevision(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	root := t.TempDir()
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = root
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v %s", args, err, output)
+		}
+	}
+	os.MkdirAll(filepath.Join(root, "src"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "src/a.txt"), []byte("tagged\n"), 0644)
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "init")
+	git("tag", "v1")
+	ioutil.WriteFile(filepath.Join(root, "src/a.txt"), []byte("working\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "src/b.txt"), []byte("untracked\n"), 0644)
+	handler := NewRootedRPCHandler(root, ClientOptions{Rev: "v1"})
+
+	if status, body := testRequest(handler, "GET /src/a.txt", "", ""); status != 200 || body != "tagged\n" {
+		t.Errorf("Unexpected GET: %d %q", status, body)
+	}
+	status, headers, _ := testRequestHeaders(handler, "HEAD /src/a.txt", "", "")
+	if status != 200 || !strings.Contains(headers, "X-ReadOnly: true") {
+		t.Errorf("Revision not served read-only: %d %q", status, headers)
+	}
+	if status, _ := testRequest(handler, "GET /src/b.txt", "", ""); status != 404 {
+		t.Errorf("Untracked file served: %d", status)
+	}
+	if status, body := testRequest(handler, "GET /src", "", ""); status != 200 || body != "a.txt\n" {
+		t.Errorf("Unexpected listing: %d %q", status, body)
+	}
+	if status, body := testRequest(handler, "POST /", "", "action=filelist"); status != 200 || body != "/src/a.txt\n" {
+		t.Errorf("Unexpected filelist: %d %q", status, body)
+	}
+	if status, _ := testRequest(handler, "PUT /src/a.txt", "", "changed"); status != 403 {
+		t.Errorf("Revision written: %d", status)
+	}
+	if status, _ := testRequest(handler, "POST /", "", "action=git-status"); status != 501 {
+		t.Errorf("Working tree action allowed: %d", status)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(root, "src/a.txt")); string(data) != "working\n" {
+		t.Errorf("Working tree changed: %q", data)
+	}
+}
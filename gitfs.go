@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Symlinks followed before giving up, like the kernel's limit
+const MAX_SYMLINK_DEPTH = 40
+
+type gitEntry struct {
+	name     string
+	mode     os.FileMode
+	size     int64
+	object   string
+	children []*gitEntry
+	target   string
+	loaded   bool
+}
+
+type gitFileInfo struct {
+	entry   *gitEntry
+	modTime time.Time
+}
+
+func (f gitFileInfo) Name() string       { return f.entry.name }
+func (f gitFileInfo) Size() int64        { return f.entry.size }
+func (f gitFileInfo) Mode() os.FileMode  { return f.entry.mode }
+func (f gitFileInfo) ModTime() time.Time { return f.modTime }
+func (f gitFileInfo) IsDir() bool        { return f.entry.mode.IsDir() }
+func (f gitFileInfo) Sys() interface{}   { return nil }
+
+// Read-only file system of the tree of a git revision, for the part of the
+// repository below rootPath. All files have the commit's time.
+type gitFileSystem struct {
+	readOnlyFileSystem
+	rootPath string
+	topLevel string
+	entries  map[string]*gitEntry
+	modTime  time.Time
+	lock     sync.Mutex
+}
+
+func runGitIn(dir string, args ...string) ([]byte, error) {
+	cmd := gitCommand(dir, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil && stderr.Len() > 0 {
+		return nil, errors.New(strings.TrimSpace(stderr.String()))
+	}
+	return output, err
+}
+
+func newGitFileSystem(rootPath string, rev string) (*gitFileSystem, error) {
+	if strings.HasPrefix(rev, "-") {
+		return nil, errors.New("Invalid revision: " + rev)
+	}
+	topLevel, err := runGitIn(rootPath, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := runGitIn(rootPath, "rev-parse", "--show-prefix")
+	if err != nil {
+		return nil, err
+	}
+	commitTime, err := runGitIn(rootPath, "log", "-1", "--format=%ct", rev, "--")
+	if err != nil {
+		return nil, err
+	}
+	seconds, _ := strconv.ParseInt(strings.TrimSpace(string(commitTime)), 10, 64)
+	fs := &gitFileSystem{
+		rootPath: rootPath,
+		topLevel: strings.TrimSpace(string(topLevel)),
+		entries:  make(map[string]*gitEntry),
+		modTime:  time.Unix(seconds, 0),
+	}
+	treeish := rev + ":" + strings.TrimSuffix(strings.TrimSpace(string(prefix)), "/")
+	output, err := runGitIn(fs.topLevel, "ls-tree", "-r", "-t", "-l", "-z", treeish)
+	if err != nil {
+		return nil, err
+	}
+	fs.entries[""] = &gitEntry{name: filepath.Base(rootPath), mode: os.ModeDir | 0755}
+	for _, record := range strings.Split(string(output), "\x00") {
+		// <mode> <type> <object> <size>\t<path>
+		tab := strings.Index(record, "\t")
+		if tab == -1 {
+			continue
+		}
+		fields := strings.Fields(record[:tab])
+		if len(fields) != 4 {
+			continue
+		}
+		relPath := record[tab+1:]
+		entry := &gitEntry{name: path.Base(relPath), object: fields[2]}
+		entry.size, _ = strconv.ParseInt(fields[3], 10, 64)
+		switch fields[0] {
+		case "040000", "160000":
+			// Submodules show up as empty directories
+			entry.mode = os.ModeDir | 0755
+			entry.size = 0
+		case "120000":
+			entry.mode = os.ModeSymlink | 0777
+		case "100755":
+			entry.mode = 0755
+		default:
+			entry.mode = 0644
+		}
+		fs.entries[relPath] = entry
+		// Trees are listed before their contents
+		parentPath := path.Dir(relPath)
+		if parentPath == "." {
+			parentPath = ""
+		}
+		if parent := fs.entries[parentPath]; parent != nil {
+			parent.children = append(parent.children, entry)
+		}
+	}
+	return fs, nil
+}
+
+func (fs *gitFileSystem) readObject(object string) ([]byte, error) {
+	return runGitIn(fs.topLevel, "cat-file", "blob", object)
+}
+
+func (fs *gitFileSystem) linkTarget(entry *gitEntry) (string, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if !entry.loaded {
+		target, err := fs.readObject(entry.object)
+		if err != nil {
+			return "", err
+		}
+		entry.target = string(target)
+		entry.loaded = true
+	}
+	return entry.target, nil
+}
+
+// Resolves a path relative to the root to its entry, following symlinks in
+// all components and, with followLast, in the last one. Returns the path of
+// the entry with symlinks resolved.
+func (fs *gitFileSystem) resolve(relPath string, followLast bool, depth int) (string, *gitEntry, error) {
+	if depth > MAX_SYMLINK_DEPTH {
+		return "", nil, errors.New("Too many levels of symbolic links")
+	}
+	current := ""
+	parts := strings.Split(relPath, "/")
+	for i, part := range parts {
+		if part == "" || part == "." {
+			continue
+		}
+		candidate := strings.TrimPrefix(current+"/"+part, "/")
+		entry := fs.entries[candidate]
+		if entry == nil {
+			return "", nil, os.ErrNotExist
+		}
+		isLast := i == len(parts)-1
+		if entry.mode&os.ModeSymlink != 0 && (!isLast || followLast) {
+			target, err := fs.linkTarget(entry)
+			if err != nil {
+				return "", nil, err
+			}
+			if path.IsAbs(target) {
+				target = relativeTo(fs.rootPath, filepath.FromSlash(target))
+			} else {
+				target = path.Join(current, target)
+			}
+			if target == ".." || strings.HasPrefix(target, "../") || path.IsAbs(target) {
+				// Outside of the root
+				return "", nil, os.ErrNotExist
+			}
+			if target == "." {
+				target = ""
+			}
+			rest := strings.Join(parts[i+1:], "/")
+			return fs.resolve(strings.TrimPrefix(target+"/"+rest, "/"), followLast, depth+1)
+		}
+		current = candidate
+	}
+	return current, fs.entries[current], nil
+}
+
+func (fs *gitFileSystem) lookup(absPath string, followLast bool) (string, *gitEntry, error) {
+	relPath := relativeTo(fs.rootPath, absPath)
+	if relPath == "." {
+		relPath = ""
+	}
+	resolved, entry, err := fs.resolve(relPath, followLast, 0)
+	if err != nil {
+		return "", nil, &os.PathError{Op: "stat", Path: absPath, Err: err}
+	}
+	return resolved, entry, nil
+}
+
+func (fs *gitFileSystem) Stat(absPath string) (os.FileInfo, error) {
+	_, entry, err := fs.lookup(absPath, true)
+	if err != nil {
+		return nil, err
+	}
+	return gitFileInfo{entry, fs.modTime}, nil
+}
+
+func (fs *gitFileSystem) Lstat(absPath string) (os.FileInfo, error) {
+	_, entry, err := fs.lookup(absPath, false)
+	if err != nil {
+		return nil, err
+	}
+	return gitFileInfo{entry, fs.modTime}, nil
+}
+
+func (fs *gitFileSystem) ReadDir(absPath string) ([]os.FileInfo, error) {
+	_, entry, err := fs.lookup(absPath, true)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: absPath, Err: errors.New("not a directory")}
+	}
+	files := make([]os.FileInfo, len(entry.children))
+	for i, child := range entry.children {
+		files[i] = gitFileInfo{child, fs.modTime}
+	}
+	return files, nil
+}
+
+func (fs *gitFileSystem) Readlink(absPath string) (string, error) {
+	_, entry, err := fs.lookup(absPath, false)
+	if err != nil {
+		return "", err
+	}
+	if entry.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: absPath, Err: errors.New("not a symlink")}
+	}
+	return fs.linkTarget(entry)
+}
+
+func (fs *gitFileSystem) EvalSymlinks(absPath string) (string, error) {
+	resolved, _, err := fs.lookup(absPath, true)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(fs.rootPath, filepath.FromSlash(resolved)), nil
+}
+
+func (fs *gitFileSystem) Open(absPath string) (io.ReadCloser, error) {
+	_, entry, err := fs.lookup(absPath, true)
+	if err != nil {
+		return nil, err
+	}
+	if entry.mode.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: absPath, Err: errors.New("is a directory")}
+	}
+	content, err := fs.readObject(entry.object)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
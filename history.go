@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Previous versions are kept here, outside of the root, unless a historydir
+// is configured
+const DEFAULT_HISTORY_DIR = "~/.zedrem/history"
+
+const DEFAULT_HISTORY_VERSIONS = 10
+
+type HistoryVersion struct {
+	Id   string    `json:"id"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+}
+
+// Where versions of all files in rootPath are stored. A shared history
+// directory gets a subdirectory per root.
+func historyStore(rootPath string, historyDir string) string {
+	if historyDir == "" {
+		historyDir = DEFAULT_HISTORY_DIR
+	}
+	historyDir = os.ExpandEnv(historyDir)
+	if strings.HasPrefix(historyDir, "~/") {
+		historyDir = os.ExpandEnv("$HOME") + historyDir[1:]
+	}
+	return filepath.Join(historyDir, fmt.Sprintf("%x", sha1.Sum([]byte(rootPath)))[:12])
+}
+
+// Directory holding the versions of a file, by its absolute path
+func (self *RootedRPCHandler) versionsPath(absPath string) string {
+	return filepath.Join(self.historyStore, filepath.FromSlash(self.relativePath(absPath))+".versions")
+}
+
+func (self *RootedRPCHandler) listVersions(absPath string) []HistoryVersion {
+	files, _ := ioutil.ReadDir(self.versionsPath(absPath))
+	versions := make([]HistoryVersion, 0, len(files))
+	for _, f := range files {
+		nanos, err := strconv.ParseInt(f.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, HistoryVersion{f.Name(), time.Unix(0, nanos), f.Size()})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Time.After(versions[j].Time)
+	})
+	return versions
+}
+
+// Keeps a copy of the current contents of absPath before it's overwritten,
+// dropping the oldest versions beyond the configured number
+func (self *RootedRPCHandler) saveVersion(absPath string) error {
+	if self.historyVersions <= 0 {
+		return nil
+	}
+	stat, err := os.Stat(absPath)
+	if err != nil || !stat.Mode().IsRegular() {
+		return nil
+	}
+	dir := self.versionsPath(absPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	versionPath := filepath.Join(dir, strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := copyFile(absPath, versionPath, 0600); err != nil {
+		return err
+	}
+	versions := self.listVersions(absPath)
+	for i := self.historyVersions; i < len(versions); i++ {
+		os.Remove(filepath.Join(dir, versions[i].Id))
+	}
+	return nil
+}
+
+func (self *RootedRPCHandler) readVersion(absPath string, id string) ([]byte, HttpError) {
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return nil, NewHttpError(http.StatusBadRequest, "Invalid version")
+	}
+	content, err := ioutil.ReadFile(filepath.Join(self.versionsPath(absPath), id))
+	if err != nil {
+		return nil, NewHttpError(http.StatusNotFound, "No such version")
+	}
+	return content, nil
+}
+
+// Actions: history-list, history-restore (version) and history-diff (version,
+// and optionally against, another version to compare with instead of the
+// current contents)
+func (self *RootedRPCHandler) handleHistory(action string, req *rpcRequest, absPath string, queryValues url.Values, responseChannel chan []byte) HttpError {
+	switch action {
+	case "history-list":
+		responseChannel <- statusCodeBuffer(200)
+		responseChannel <- headerBuffer(map[string]string{"Content-Type": "application/json"})
+		json.NewEncoder(&channelWriter{responseChannel}).Encode(self.listVersions(absPath))
+		return nil
+	case "history-restore":
+		content, httpErr := self.readVersion(absPath, queryValues.Get("version"))
+		if httpErr != nil {
+			return httpErr
+		}
+		if !self.acquireWriteLock(req.path) {
+			return NewHttpError(http.StatusConflict, "Write already going on")
+		}
+		defer self.releaseWriteLock(req.path)
+		if httpErr := self.writeFile(absPath, bytes.NewReader(content)); httpErr != nil {
+			return httpErr
+		}
+		stat, _ := os.Stat(absPath)
+		responseChannel <- statusCodeBuffer(200)
+		responseChannel <- headerBuffer(map[string]string{
+			"Content-Type": "text/plain",
+			"ETag":         stat.ModTime().String(),
+		})
+		responseChannel <- []byte("OK")
+		return nil
+	case "history-diff":
+		version := queryValues.Get("version")
+		old, httpErr := self.readVersion(absPath, version)
+		if httpErr != nil {
+			return httpErr
+		}
+		against := queryValues.Get("against")
+		var current []byte
+		if against != "" {
+			current, httpErr = self.readVersion(absPath, against)
+			if httpErr != nil {
+				return httpErr
+			}
+		} else {
+			current, _ = ioutil.ReadFile(absPath)
+			against = "current"
+		}
+		name := self.relativePath(absPath)
+		diff := unifiedDiff(name+"@"+version, name+"@"+against, string(old), string(current), 3)
+		responseChannel <- statusCodeBuffer(200)
+		responseChannel <- headerBuffer(map[string]string{"Content-Type": "text/x-diff"})
+		if diff != "" {
+			(&channelWriter{responseChannel}).Write([]byte(diff))
+		}
+		return nil
+	}
+	return NewHttpError(http.StatusNotImplemented, "No such action")
+}
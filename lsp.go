@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Largest message read from the editor or a language server
+const MAX_LSP_MESSAGE_SIZE = 64 * 1024 * 1024
+
+// Reads a single Content-Length framed JSON-RPC message
+func readLspMessage(reader *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+			if err != nil {
+				return nil, errors.New("Invalid Content-Length")
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("No Content-Length")
+	}
+	if length > MAX_LSP_MESSAGE_SIZE {
+		return nil, errors.New("Message too large")
+	}
+	body := make([]byte, length)
+	_, err := io.ReadFull(reader, body)
+	return body, err
+}
+
+func frameLspMessage(body []byte) []byte {
+	return append([]byte(fmt.Sprintf("Content-Length: %d\r\n\r\n", len(body))), body...)
+}
+
+func translateUri(s string, from string, to string) string {
+	if s == from || strings.HasPrefix(s, from+"/") {
+		return to + s[len(from):]
+	}
+	return s
+}
+
+func translateUris(value interface{}, from string, to string) interface{} {
+	switch v := value.(type) {
+	case string:
+		return translateUri(v, from, to)
+	case []interface{}:
+		for i := range v {
+			v[i] = translateUris(v[i], from, to)
+		}
+	case map[string]interface{}:
+		// URIs are also used as keys, e.g. in WorkspaceEdit.changes
+		translated := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			translated[translateUri(key, from, to)] = translateUris(value, from, to)
+		}
+		return translated
+	}
+	return value
+}
+
+// Rewrites every URI in a JSON-RPC message starting with from to start with
+// to instead
+func translateLspMessage(body []byte, from string, to string) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var message interface{}
+	if err := decoder.Decode(&message); err != nil {
+		return body
+	}
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(translateUris(message, from, to)); err != nil {
+		return body
+	}
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n"))
+}
+
+func (self *RootedRPCHandler) findLanguageServer(queryValues url.Values) *LanguageServerConfig {
+	if name := queryValues.Get("name"); name != "" {
+		return self.languageServers[name]
+	}
+	ext := strings.TrimPrefix(queryValues.Get("ext"), ".")
+	for _, server := range self.languageServers {
+		for _, e := range server.Extension {
+			if strings.TrimPrefix(e, ".") == ext {
+				return server
+			}
+		}
+	}
+	return nil
+}
+
+// Runs the language server configured in ~/.zedremrc for name or ext in the
+// requested directory, bridging its stdio as stream messages. URIs below the
+// root are translated to and from base, the editor's URL for the root.
+func (self *RootedRPCHandler) handleLsp(req *rpcRequest, requestChannel chan []byte, responseChannel chan []byte) HttpError {
+	dropUntilDelimiter(requestChannel)
+	dirPath, httpErr := self.resolvePath(req.path)
+	if httpErr != nil {
+		return httpErr
+	}
+	if stat, err := os.Stat(dirPath); err != nil || !stat.IsDir() {
+		return NewHttpError(http.StatusBadRequest, "Working directory is not a directory")
+	}
+	server := self.findLanguageServer(req.query)
+	if server == nil || server.Command == "" {
+		return NewHttpError(http.StatusNotFound, "No language server configured")
+	}
+	rootUri := (&url.URL{Scheme: "file", Path: filepath.ToSlash(self.rootPath)}).String()
+	base := strings.TrimSuffix(req.query.Get("base"), "/")
+	if base == "" {
+		base = rootUri
+	}
+
+	cmd := exec.Command(server.Command, server.Arg...)
+	cmd.Dir = dirPath
+	setProcessGroup(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return NewHttpError(http.StatusInternalServerError, err.Error())
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return NewHttpError(http.StatusInternalServerError, err.Error())
+	}
+	if err := cmd.Start(); err != nil {
+		return NewHttpError(http.StatusInternalServerError, "Could not start language server: "+err.Error())
+	}
+
+	responseChannel <- statusCodeBuffer(200)
+	responseChannel <- headerBuffer(map[string]string{"Content-Type": "application/x-zedrem-lsp"})
+	exited := make(chan bool)
+	go func() {
+		reader := bufio.NewReader(stdout)
+		writer := &channelWriter{responseChannel}
+		for {
+			body, err := readLspMessage(reader)
+			if err != nil {
+				break
+			}
+			message := frameLspMessage(translateLspMessage(body, rootUri, base))
+			for len(message) > 0 {
+				n := len(message)
+				if n > BUFFER_SIZE-1 {
+					n = BUFFER_SIZE - 1
+				}
+				writer.Write(streamMessage(STREAM_DATA, message[:n]))
+				message = message[n:]
+			}
+		}
+		exitCode := -1
+		if cmd.Wait() == nil {
+			exitCode = 0
+		} else if cmd.ProcessState != nil {
+			exitCode = cmd.ProcessState.ExitCode()
+		}
+		responseChannel <- streamMessage(STREAM_END, []byte(strconv.Itoa(exitCode)))
+		close(exited)
+	}()
+
+	// Messages from the editor may be split over several stream messages
+	input, inputWriter := io.Pipe()
+	go func() {
+		reader := bufio.NewReader(input)
+		for {
+			body, err := readLspMessage(reader)
+			if err != nil {
+				input.CloseWithError(err)
+				return
+			}
+			if _, err := stdin.Write(frameLspMessage(translateLspMessage(body, base, rootUri))); err != nil {
+				input.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	for {
+		buffer, ok := <-requestChannel
+		if !ok || IsCancel(buffer) {
+			break
+		}
+		if len(buffer) > 0 && buffer[0] == STREAM_DATA {
+			inputWriter.Write(buffer[1:])
+		}
+	}
+	inputWriter.Close()
+	stdin.Close()
+	// Children of the server may keep its output open
+	killProcessGroup(cmd)
+	stdout.Close()
+	<-exited
+	return nil
+}
+
+// Relays a websocket at /lsp/<id>/<path>?name=server (or ?ext=extension) to
+// a language server on the client. URIs are translated to the session's
+// /fs/<id> URL.
+func lspServer(ws *websocket.Conn) {
+	defer ws.Close()
+	defer quietPanicRecover()
+	r := ws.Request()
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/lsp/"), "/")
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	query := r.URL.Query()
+	query.Set("base", fmt.Sprintf("%s://%s/fs/%s", scheme, r.Host, parts[0]))
+	requestLine := "LSP /" + strings.Join(parts[1:], "/") + "?" + query.Encode()
+	relayStreamWebsocket(ws, parts[0], requestLine)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestTranslateLspMessage(t *testing.T) {
+	message := `{"id":9007199254740993,"params":{"uri":"file:///root/src/a.go","other":"file:///rootless","changes":{"file:///root/b.go":[]}}}`
+	expected := `{"id":9007199254740993,"params":{"changes":{"http://relay/fs/x/b.go":[]},"other":"file:///rootless","uri":"http://relay/fs/x/src/a.go"}}`
+	if translated := string(translateLspMessage([]byte(message), "file:///root", "http://relay/fs/x")); translated != expected {
+		t.Errorf("Unexpected translation: %s", translated)
+	}
+}
+
+func TestReadLspMessage(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("Content-Length: 2\r\n\r\n{}Content-Length: 99999999999\r\n\r\n"))
+	if body, err := readLspMessage(reader); err != nil || string(body) != "{}" {
+		t.Errorf("Unexpected message %q, %v", body, err)
+	}
+	if _, err := readLspMessage(reader); err == nil {
+		t.Errorf("Read a message larger than MAX_LSP_MESSAGE_SIZE")
+	}
+}
+
+func TestReadOnlyLsp(t *testing.T) {
+	handler := NewRootedRPCHandler(t.TempDir(), ClientOptions{ReadOnly: true})
+	if status, _ := testRequest(handler, "LSP /?name=go", "", ""); status != 403 {
+		t.Errorf("Language server started in read-only mode: %d", status)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type memoryNode struct {
+	mode     os.FileMode
+	modTime  time.Time
+	size     int64
+	data     []byte
+	children map[string]*memoryNode
+	// Reads the contents instead of data, for archive entries loaded lazily
+	open func() (io.ReadCloser, error)
+}
+
+type memoryFileInfo struct {
+	name string
+	node *memoryNode
+}
+
+func (f memoryFileInfo) Name() string       { return f.name }
+func (f memoryFileInfo) Size() int64        { return f.node.size }
+func (f memoryFileInfo) Mode() os.FileMode  { return f.node.mode }
+func (f memoryFileInfo) ModTime() time.Time { return f.node.modTime }
+func (f memoryFileInfo) IsDir() bool        { return f.node.mode.IsDir() }
+func (f memoryFileInfo) Sys() interface{}   { return nil }
+
+type memoryWatcher struct {
+	root   string
+	skip   watchFilter
+	lock   sync.Mutex
+	queue  []WatchEvent
+	notify chan bool
+}
+
+// A file system kept in memory, rooted at rootPath. There are no symlinks.
+type memoryFileSystem struct {
+	rootPath string
+	readOnly bool
+	lock     sync.Mutex
+	root     *memoryNode
+	watchers map[*memoryWatcher]bool
+}
+
+func newMemoryFileSystem(rootPath string) *memoryFileSystem {
+	return &memoryFileSystem{
+		rootPath: rootPath,
+		root:     newMemoryDir(time.Now()),
+		watchers: make(map[*memoryWatcher]bool),
+	}
+}
+
+func newMemoryDir(modTime time.Time) *memoryNode {
+	return &memoryNode{
+		mode:     os.ModeDir | 0755,
+		modTime:  modTime.Round(0),
+		children: make(map[string]*memoryNode),
+	}
+}
+
+func memoryError(op string, absPath string, err error) error {
+	return &os.PathError{Op: op, Path: absPath, Err: err}
+}
+
+// Path components of absPath below the root, nil for the root itself
+func (fs *memoryFileSystem) split(absPath string) ([]string, bool) {
+	relPath := relativeTo(fs.rootPath, absPath)
+	if relPath == "." {
+		return nil, true
+	}
+	if relPath == ".." || strings.HasPrefix(relPath, "../") || filepath.IsAbs(relPath) {
+		return nil, false
+	}
+	return strings.Split(relPath, "/"), true
+}
+
+// Finds the node at absPath, must be called with the lock held
+func (fs *memoryFileSystem) lookup(op string, absPath string) (*memoryNode, error) {
+	parts, ok := fs.split(absPath)
+	if !ok {
+		return nil, memoryError(op, absPath, os.ErrNotExist)
+	}
+	node := fs.root
+	for _, part := range parts {
+		if node.children == nil {
+			return nil, memoryError(op, absPath, syscall.ENOTDIR)
+		}
+		if node = node.children[part]; node == nil {
+			return nil, memoryError(op, absPath, os.ErrNotExist)
+		}
+	}
+	return node, nil
+}
+
+// Finds the directory absPath is in, creating it with parents. Must be called
+// with the lock held.
+func (fs *memoryFileSystem) parent(op string, absPath string, parents bool) (*memoryNode, string, error) {
+	parts, ok := fs.split(absPath)
+	if !ok || len(parts) == 0 {
+		return nil, "", memoryError(op, absPath, os.ErrPermission)
+	}
+	dir := fs.root
+	for i, part := range parts[:len(parts)-1] {
+		child := dir.children[part]
+		if child == nil {
+			if !parents {
+				return nil, "", memoryError(op, absPath, os.ErrNotExist)
+			}
+			child = newMemoryDir(time.Now())
+			dir.children[part] = child
+			fs.notify("create", filepath.Join(fs.rootPath, filepath.FromSlash(strings.Join(parts[:i+1], "/"))), "", true)
+		}
+		if child.children == nil {
+			return nil, "", memoryError(op, absPath, syscall.ENOTDIR)
+		}
+		dir = child
+	}
+	return dir, parts[len(parts)-1], nil
+}
+
+func (fs *memoryFileSystem) Stat(absPath string) (os.FileInfo, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, err := fs.lookup("stat", absPath)
+	if err != nil {
+		return nil, err
+	}
+	return memoryFileInfo{filepath.Base(absPath), node}, nil
+}
+
+func (fs *memoryFileSystem) Lstat(absPath string) (os.FileInfo, error) {
+	return fs.Stat(absPath)
+}
+
+func (fs *memoryFileSystem) ReadDir(absPath string) ([]os.FileInfo, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, err := fs.lookup("readdir", absPath)
+	if err != nil {
+		return nil, err
+	}
+	if node.children == nil {
+		return nil, memoryError("readdir", absPath, syscall.ENOTDIR)
+	}
+	files := make([]os.FileInfo, 0, len(node.children))
+	for name, child := range node.children {
+		files = append(files, memoryFileInfo{name, child})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, nil
+}
+
+func (fs *memoryFileSystem) Readlink(absPath string) (string, error) {
+	if _, err := fs.Lstat(absPath); err != nil {
+		return "", err
+	}
+	return "", memoryError("readlink", absPath, errors.New("not a symlink"))
+}
+
+func (fs *memoryFileSystem) EvalSymlinks(absPath string) (string, error) {
+	if _, err := fs.Lstat(absPath); err != nil {
+		return "", err
+	}
+	return filepath.Clean(absPath), nil
+}
+
+func (fs *memoryFileSystem) Open(absPath string) (io.ReadCloser, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, err := fs.lookup("open", absPath)
+	if err != nil {
+		return nil, err
+	}
+	if node.children != nil {
+		return nil, memoryError("open", absPath, syscall.EISDIR)
+	}
+	if node.open != nil {
+		return node.open()
+	}
+	return ioutil.NopCloser(bytes.NewReader(node.data)), nil
+}
+
+// The contents are read before anything changes, and never modified in place
+// after, so open readers keep seeing the previous contents
+func (fs *memoryFileSystem) WriteFile(absPath string, r io.Reader) error {
+	if fs.readOnly {
+		return memoryError("write", absPath, os.ErrPermission)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	dir, name, err := fs.parent("write", absPath, true)
+	if err != nil {
+		return err
+	}
+	node := dir.children[name]
+	eventType := "modify"
+	if node == nil {
+		node = &memoryNode{mode: 0644}
+		dir.children[name] = node
+		eventType = "create"
+	} else if node.children != nil {
+		return memoryError("write", absPath, syscall.EISDIR)
+	}
+	node.data = data
+	node.size = int64(len(data))
+	node.open = nil
+	node.modTime = time.Now().Round(0)
+	fs.notify(eventType, absPath, "", false)
+	return nil
+}
+
+func (fs *memoryFileSystem) Mkdir(absPath string, parents bool) error {
+	if fs.readOnly {
+		return memoryError("mkdir", absPath, os.ErrPermission)
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	dir, name, err := fs.parent("mkdir", absPath, parents)
+	if err != nil {
+		return err
+	}
+	if node := dir.children[name]; node != nil {
+		if parents && node.children != nil {
+			return nil
+		}
+		return memoryError("mkdir", absPath, os.ErrExist)
+	}
+	dir.children[name] = newMemoryDir(time.Now())
+	fs.notify("create", absPath, "", true)
+	return nil
+}
+
+func (fs *memoryFileSystem) Remove(absPath string, recursive bool) error {
+	if fs.readOnly {
+		return memoryError("remove", absPath, os.ErrPermission)
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, err := fs.lookup("remove", absPath)
+	if err != nil {
+		if recursive && os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if node == fs.root {
+		return memoryError("remove", absPath, os.ErrPermission)
+	}
+	if len(node.children) > 0 && !recursive {
+		return memoryError("remove", absPath, syscall.ENOTEMPTY)
+	}
+	dir, name, _ := fs.parent("remove", absPath, false)
+	delete(dir.children, name)
+	fs.notify("delete", absPath, "", node.children != nil)
+	return nil
+}
+
+func (fs *memoryFileSystem) Rename(source string, destination string) error {
+	if fs.readOnly {
+		return memoryError("rename", source, os.ErrPermission)
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, err := fs.lookup("rename", source)
+	if err != nil {
+		return err
+	}
+	if node == fs.root || (node.children != nil && isBelow(source, destination)) {
+		return memoryError("rename", source, syscall.EINVAL)
+	}
+	destDir, destName, err := fs.parent("rename", destination, false)
+	if err != nil {
+		return err
+	}
+	if existing := destDir.children[destName]; existing != nil && len(existing.children) > 0 {
+		return memoryError("rename", destination, syscall.ENOTEMPTY)
+	}
+	sourceDir, sourceName, _ := fs.parent("rename", source, false)
+	delete(sourceDir.children, sourceName)
+	destDir.children[destName] = node
+	fs.notify("rename", destination, source, node.children != nil)
+	return nil
+}
+
+func (fs *memoryFileSystem) Copy(source string, destination string, recursive bool) error {
+	if fs.readOnly {
+		return memoryError("copy", destination, os.ErrPermission)
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node, err := fs.lookup("copy", source)
+	if err != nil {
+		return err
+	}
+	if node.children != nil && isBelow(source, destination) {
+		return memoryError("copy", destination, syscall.EINVAL)
+	}
+	dir, name, err := fs.parent("copy", destination, false)
+	if err != nil {
+		return err
+	}
+	if dir.children[name] != nil {
+		return memoryError("copy", destination, os.ErrExist)
+	}
+	dir.children[name] = copyMemoryNode(node, recursive)
+	fs.notify("create", destination, "", node.children != nil)
+	return nil
+}
+
+func copyMemoryNode(node *memoryNode, recursive bool) *memoryNode {
+	clone := *node
+	if node.children != nil {
+		clone.children = make(map[string]*memoryNode)
+		if recursive {
+			for name, child := range node.children {
+				clone.children[name] = copyMemoryNode(child, true)
+			}
+		}
+	}
+	return &clone
+}
+
+// Whether absPath is dirPath or inside it
+func isBelow(dirPath string, absPath string) bool {
+	relPath := relativeTo(dirPath, absPath)
+	return relPath == "." || !(relPath == ".." || strings.HasPrefix(relPath, "../") || filepath.IsAbs(relPath))
+}
+
+// Events are queued per watcher so writers never wait for them to be read
+func (fs *memoryFileSystem) Watch(absPath string, skip watchFilter, done chan bool) (chan WatchEvent, error) {
+	if _, err := fs.Stat(absPath); err != nil {
+		return nil, err
+	}
+	watcher := &memoryWatcher{root: absPath, skip: skip, notify: make(chan bool, 1)}
+	fs.lock.Lock()
+	fs.watchers[watcher] = true
+	fs.lock.Unlock()
+
+	events := make(chan WatchEvent)
+	go func() {
+		defer close(events)
+		defer func() {
+			fs.lock.Lock()
+			delete(fs.watchers, watcher)
+			fs.lock.Unlock()
+		}()
+		for {
+			select {
+			case <-done:
+				return
+			case <-watcher.notify:
+			}
+			watcher.lock.Lock()
+			queue := watcher.queue
+			watcher.queue = nil
+			watcher.lock.Unlock()
+			for _, event := range queue {
+				select {
+				case events <- event:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Whether a change to absPath is below the watched directory and not skipped,
+// checking the directories in between like a walk would
+func (w *memoryWatcher) watches(absPath string, isDir bool) bool {
+	relPath := relativeTo(w.root, absPath)
+	if relPath == "." || !isBelow(w.root, absPath) {
+		return false
+	}
+	parts := strings.Split(relPath, "/")
+	current := w.root
+	for i, part := range parts {
+		current = filepath.Join(current, part)
+		if w.skip(current, isDir || i < len(parts)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+// Must be called with the lock held
+func (fs *memoryFileSystem) notify(eventType string, absPath string, from string, isDir bool) {
+	for watcher := range fs.watchers {
+		event := WatchEvent{Type: eventType, Path: absPath, From: from}
+		if !watcher.watches(absPath, isDir) {
+			if from == "" || !watcher.watches(from, isDir) {
+				continue
+			}
+			// Moved out of sight
+			event = WatchEvent{Type: "delete", Path: from}
+		} else if from != "" && !watcher.watches(from, isDir) {
+			event = WatchEvent{Type: "create", Path: absPath}
+		}
+		watcher.lock.Lock()
+		watcher.queue = append(watcher.queue, event)
+		watcher.lock.Unlock()
+		select {
+		case watcher.notify <- true:
+		default:
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// Only the process itself, Windows has no process groups to kill
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -9,6 +9,11 @@ type HelloMessage struct {
 	Version string
 	UUID string
 	UserKey string
+	// Proves the client may use UUID, see authenticateHello
+	Secret string
+	// Set when the client connects again after losing its connection, the
+	// editor already has a window open for it then
+	Reconnect bool
 }
 
 type EditSocketMessage struct {
@@ -18,8 +23,29 @@ type EditSocketMessage struct {
 
 const DELIMITER = "11~~~~~!!END!!~~~~~11"
 var DELIMITERBUFFER = []byte(DELIMITER)
+// Sent by the server after the request's delimiter when the requesting HTTP
+// client went away, so long running requests can stop
+const CANCEL = "11~~~~~!!CANCEL!!~~~~~11"
+var CANCELBUFFER = []byte(CANCEL)
 const BUFFER_SIZE = 4096
 
+// Bidirectional streams (terminals, forwarded ports) keep exchanging
+// messages after the request's delimiter and the response headers, each
+// starting with one of these bytes:
+//   'd' <bytes>  data
+//   'x' <bytes>  end of the stream, from the client
+// The relay answers the end (or its own side going away) with a CANCEL, sends
+// nothing more after it, and the client then ends the response with the
+// delimiter.
+const (
+	STREAM_DATA = 'd'
+	STREAM_END  = 'x'
+)
+
+func streamMessage(kind byte, data []byte) []byte {
+	return append([]byte{kind}, data...)
+}
+
 const PROTOCOL_VERSION = "1.0"
 
 func ReadFrame(r io.Reader) (requestId byte, buffer []byte, err error) {
@@ -73,6 +99,10 @@ func IsDelimiter(buffer []byte) bool {
   return false
 }
 
+func IsCancel(buffer []byte) bool {
+	return bytes.Equal(buffer, CANCELBUFFER)
+}
+
 func IntToBytes(n int) []byte {
 	buf := make([]byte, 2)
 	buf[0] = byte(n / 256)
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+func startPty(cmd *exec.Cmd) (*os.File, error) {
+	return nil, errors.New("Terminals not supported on this platform")
+}
+
+func resizePty(master *os.File, rows int, cols int) error {
+	return errors.New("Terminals not supported on this platform")
+}
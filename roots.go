@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A root served under its name, when a session serves more than one
+type NamedRoot struct {
+	Name string
+	Path string
+}
+
+// Parses name=path arguments. A single argument without a name is a plain
+// directory, for which nil is returned.
+func parseNamedRoots(args []string) ([]NamedRoot, error) {
+	var roots []NamedRoot
+	seen := make(map[string]bool)
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			if len(args) == 1 {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("Expected name=path when serving more than one directory, got %s", arg)
+		}
+		name := parts[0]
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\?#") {
+			return nil, fmt.Errorf("Invalid root name: %s", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("Root %s given more than once", name)
+		}
+		seen[name] = true
+		roots = append(roots, NamedRoot{name, parts[1]})
+	}
+	return roots, nil
+}
+
+// Serves several roots in one session, each under /<name>/ with its own
+// handler. The path / lists the roots.
+type MultiRootHandler struct {
+	names []string
+	roots map[string]*RootedRPCHandler
+}
+
+// Every root gets the session's options, plus the read-only flag and
+// include and exclude rules of its [root "name"] section
+func NewMultiRootHandler(options ClientOptions) *MultiRootHandler {
+	handler := &MultiRootHandler{roots: make(map[string]*RootedRPCHandler)}
+	for _, root := range options.Roots {
+		rootOptions := options
+		if config := options.RootConfigs[root.Name]; config != nil {
+			rootOptions.ReadOnly = options.ReadOnly || config.ReadOnly
+			rootOptions.Include = append(append([]string{}, options.Include...), config.Include...)
+			rootOptions.Exclude = append(append([]string{}, options.Exclude...), config.Exclude...)
+		}
+		rootPath, err := filepath.Abs(root.Path)
+		if err != nil {
+			fmt.Println("Could not resolve root", root.Name, err)
+			os.Exit(4)
+		}
+		handler.names = append(handler.names, root.Name)
+		handler.roots[root.Name] = NewRootedRPCHandler(rootPath, rootOptions)
+	}
+	return handler
+}
+
+func (self *MultiRootHandler) handleRequest(requestChannel chan []byte, responseChannel chan []byte, closeChannel chan bool) {
+	req, ok := readRequest(requestChannel)
+	if !ok {
+		closeChannel <- true
+		return
+	}
+	parts := strings.SplitN(req.path, "/", 2)
+	name := parts[0]
+	var err HttpError
+	switch {
+	case req.method == "CONNECT":
+		// Forwarded ports belong to the session, not to a root
+		self.roots[self.names[0]].serveRequest(req, requestChannel, responseChannel)
+	case name == "":
+		err = self.handleRootList(req, requestChannel, responseChannel)
+	case self.roots[name] == nil:
+		dropUntilDelimiter(requestChannel)
+		err = NewHttpError(http.StatusNotFound, "No such root")
+	default:
+		if err = rebaseRequest(req, name); err != nil {
+			dropUntilDelimiter(requestChannel)
+			break
+		}
+		self.roots[name].serveRequest(req, requestChannel, responseChannel)
+	}
+	if err != nil {
+		sendError(responseChannel, err, req.method != "HEAD")
+	}
+	responseChannel <- DELIMITERBUFFER
+	closeChannel <- true
+}
+
+// Makes the paths in a request for the root name relative to that root
+func rebaseRequest(req *rpcRequest, name string) HttpError {
+	prefix := "/" + name
+	req.path = strings.TrimPrefix(strings.TrimPrefix(req.path, name), "/")
+	if destination := req.header.Get("Destination"); destination != "" {
+		if destination != prefix && !strings.HasPrefix(destination, prefix+"/") {
+			return NewHttpError(http.StatusBadGateway, "Destination is in another root")
+		}
+		req.header.Set("Destination", "/"+strings.TrimPrefix(destination[len(prefix):], "/"))
+	}
+	// The editor's URL for the root, see handleLsp
+	if base := req.query.Get("base"); base != "" {
+		req.query.Set("base", strings.TrimSuffix(base, "/")+prefix)
+	}
+	return nil
+}
+
+// Lists the roots like a directory, see listDirectory. Besides GET and HEAD
+// only the version action is available here.
+func (self *MultiRootHandler) handleRootList(req *rpcRequest, requestChannel chan []byte, responseChannel chan []byte) HttpError {
+	switch req.method {
+	case "HEAD":
+		dropUntilDelimiter(requestChannel)
+		responseChannel <- statusCodeBuffer(200)
+		responseChannel <- headerBuffer(map[string]string{
+			"Content-Length": "0",
+			"X-Type":         "directory",
+		})
+		return nil
+	case "POST":
+		body, err := readWholeBody(requestChannel)
+		if err != nil {
+			return err
+		}
+		queryValues, _ := url.ParseQuery(string(body))
+		if queryValues.Get("action") != "version" {
+			return NewHttpError(http.StatusNotImplemented, "Pick a root first")
+		}
+		responseChannel <- statusCodeBuffer(200)
+		responseChannel <- headerBuffer(map[string]string{"Content-Type": "text/plain"})
+		responseChannel <- []byte(PROTOCOL_VERSION)
+		return nil
+	case "GET":
+		dropUntilDelimiter(requestChannel)
+	default:
+		dropUntilDelimiter(requestChannel)
+		return NewHttpError(http.StatusMethodNotAllowed, "Method not allowed on the list of roots")
+	}
+
+	responseChannel <- statusCodeBuffer(200)
+	if req.accepts("application/json") {
+		responseChannel <- headerBuffer(map[string]string{"Content-Type": "application/json"})
+		entries := make([]DirectoryEntry, 0, len(self.names))
+		for _, name := range self.names {
+			root := self.roots[name]
+			stat, err := root.fs.Stat(root.rootPath)
+			if err != nil {
+				continue
+			}
+			entry := root.newDirectoryEntry(filepath.Dir(root.rootPath), stat)
+			entry.Name = name
+			entries = append(entries, entry)
+		}
+		json.NewEncoder(&channelWriter{responseChannel}).Encode(entries)
+		return nil
+	}
+	responseChannel <- headerBuffer(map[string]string{"Content-Type": "text/plain"})
+	for _, name := range self.names {
+		responseChannel <- []byte(name + "/\n")
+	}
+	return nil
+}
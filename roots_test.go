@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMultiRootHandler(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"svc", "lib"} {
+		os.Mkdir(filepath.Join(dir, name), 0777)
+		ioutil.WriteFile(filepath.Join(dir, name, "main.go"), []byte(name), 0666)
+	}
+	roots, err := parseNamedRoots([]string{"api=" + filepath.Join(dir, "svc"), "lib=" + filepath.Join(dir, "lib")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewMultiRootHandler(ClientOptions{
+		Roots:       roots,
+		RootConfigs: map[string]*RootConfig{"lib": {ReadOnly: true}},
+	})
+
+	if status, body := testRequest(handler, "GET /", "", ""); status != 200 || body != "api/\nlib/\n" {
+		t.Errorf("Unexpected root listing: %d %q", status, body)
+	}
+	if _, body := testRequest(handler, "GET /lib/main.go", "", ""); body != "lib" {
+		t.Errorf("Unexpected contents: %q", body)
+	}
+	if status, _ := testRequest(handler, "PUT /api/new.go", "", "new"); status != 200 {
+		t.Errorf("Could not write to api: %d", status)
+	}
+	if status, _ := testRequest(handler, "PUT /lib/new.go", "", "new"); status != 403 {
+		t.Errorf("Wrote to read-only lib: %d", status)
+	}
+	if status, _ := testRequest(handler, "MOVE /api/new.go", "Destination: /lib/new.go", ""); status != 502 {
+		t.Errorf("Moved between roots: %d", status)
+	}
+	if status, _ := testRequest(handler, "GET /other/main.go", "", ""); status != 404 {
+		t.Errorf("Unexpected status for unknown root: %d", status)
+	}
+	if _, err := parseNamedRoots([]string{"a=x", "plain"}); err == nil {
+		t.Errorf("Mixed named and plain roots accepted")
+	}
+}
+
+func TestWriteLockPerRoot(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"api", "lib"} {
+		os.Mkdir(filepath.Join(dir, name), 0777)
+	}
+	roots, err := parseNamedRoots([]string{"api=" + filepath.Join(dir, "api"), "lib=" + filepath.Join(dir, "lib")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewMultiRootHandler(ClientOptions{Roots: roots})
+
+	// A write to api/go.mod going on
+	if !handler.roots["api"].acquireWriteLock("go.mod") {
+		t.Fatal("Could not lock api/go.mod")
+	}
+	defer handler.roots["api"].releaseWriteLock("go.mod")
+	if status, _ := testRequest(handler, "PUT /lib/go.mod", "", "module lib"); status != 200 {
+		t.Errorf("Write to lib/go.mod blocked by api/go.mod: %d", status)
+	}
+	if _, body := testRequest(handler, "GET /lib/go.mod", "", ""); body != "module lib" {
+		t.Errorf("Unexpected contents: %q", body)
+	}
+}
+
+func TestParseNamedRootFlags(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	options := ParseClientFlags([]string{"-readonly", "app=/src/app", "lib=/src/lib"})
+	if len(options.Roots) != 2 || options.RootPath != "" {
+		t.Errorf("Unexpected roots %v and root path %q", options.Roots, options.RootPath)
+	}
+	options = ParseClientFlags([]string{"-readonly", "/src/app"})
+	if len(options.Roots) != 0 || options.RootPath != "/src/app" {
+		t.Errorf("Unexpected roots %v and root path %q", options.Roots, options.RootPath)
+	}
+}
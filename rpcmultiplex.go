@@ -4,12 +4,42 @@ import (
 	"fmt"
 	"io"
 	"errors"
+	"sync"
 )
 
 type Request struct {
 	requestChannel chan []byte
 	responseChannel chan []byte
 	closeChannel chan bool
+	// Closed once the handler finished, nothing is passed on to it after that
+	done chan bool
+	sendLock sync.Mutex
+}
+
+// Passes buffer on to the handler, unless it finished. A handler that
+// stopped reading can't block this once it's done.
+func (req *Request) send(buffer []byte) {
+	req.sendLock.Lock()
+	defer req.sendLock.Unlock()
+	select {
+	case <-req.done:
+		return
+	default:
+	}
+	select {
+	case req.requestChannel <- buffer:
+	case <-req.done:
+	}
+}
+
+func (req *Request) close() {
+	close(req.done)
+	// Waits for a send going on to give up
+	req.sendLock.Lock()
+	defer req.sendLock.Unlock()
+	close(req.requestChannel)
+	close(req.responseChannel)
+	close(req.closeChannel)
 }
 
 type RPCHandler interface {
@@ -21,31 +51,66 @@ type RPCMultiplexer struct {
 	OutstandingRequests []*Request
 	writeChannel chan []byte
 	handler RPCHandler
+	lock sync.Mutex
+	// Response listeners still running, the writer stops once all are done
+	listeners sync.WaitGroup
+	// Closed when the writer stopped, after shutdown
+	stopped chan bool
 }
 
 func NewRPCMultiplexer(rw io.ReadWriter, handler RPCHandler) *RPCMultiplexer {
 	return &RPCMultiplexer {
 		rw: rw,
 		handler: handler,
+		stopped: make(chan bool),
 	}
 }
 
 func (m *RPCMultiplexer) writer() {
+	defer close(m.stopped)
+	failed := false
 	for {
 		buffer, ok := <-m.writeChannel
 		if !ok {
 			break
 		}
+		if failed {
+			// Keep draining so handlers that are still finishing up don't block
+			continue
+		}
 		err := WriteFrame(m.rw, buffer[0], buffer[1:])
 		if err != nil {
 			fmt.Println("Couldn't write frame", err)
-			close(m.writeChannel)
-			break
+			failed = true
 		}
 	}
 }
 
+// Asks all running handlers to stop, used when the connection is lost.
+// Handlers read the cancel whenever they next read their request channel,
+// so it's sent without waiting for that.
+func (m *RPCMultiplexer) cancelAll() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, req := range m.OutstandingRequests {
+		if req == nil {
+			continue
+		}
+		go req.send(CANCELBUFFER)
+	}
+}
+
+// Cancels all requests and stops the writer once their handlers are done
+func (m *RPCMultiplexer) shutdown() {
+	m.cancelAll()
+	go func() {
+		m.listeners.Wait()
+		close(m.writeChannel)
+	}()
+}
+
 func (m *RPCMultiplexer) responseListener(requestId byte, responseChannel chan []byte) {
+	defer m.listeners.Done()
 	for {
 		buffer, ok := <-responseChannel
 		if !ok {
@@ -57,12 +122,11 @@ func (m *RPCMultiplexer) responseListener(requestId byte, responseChannel chan [
 
 func (m *RPCMultiplexer) closeListener(requestId byte, closeChannel chan bool) {
 	_ = <-closeChannel
+	m.lock.Lock()
 	req := m.OutstandingRequests[requestId]
-	//fmt.Println("Now going to close stuff for", req)
-	close(req.requestChannel)
-	close(req.responseChannel)
-	close(req.closeChannel)
 	m.OutstandingRequests[requestId] = nil
+	m.lock.Unlock()
+	req.close()
 }
 
 func (m *RPCMultiplexer) Multiplex() error {
@@ -74,24 +138,36 @@ func (m *RPCMultiplexer) Multiplex() error {
 	for {
 		requestId, buffer, err := ReadFrame(m.rw)
 		if err != nil {
+			m.shutdown()
 			return err
 		}
 		if requestId == 0 {
+			m.shutdown()
 		        return errors.New(string(buffer))
 		}
+		m.lock.Lock()
 		req := m.OutstandingRequests[requestId]
+		if req == nil && IsCancel(buffer) {
+			// Request was already done
+			m.lock.Unlock()
+			continue
+		}
 		if req == nil {
 			req = &Request {
 				requestChannel: make(chan []byte, 10),
 				responseChannel: make(chan []byte, 10),
 				closeChannel: make(chan bool),
+				done: make(chan bool),
 			}
 			m.OutstandingRequests[requestId] = req
+			m.listeners.Add(1)
 			go m.responseListener(requestId, req.responseChannel)
 			go m.closeListener(requestId, req.closeChannel)
 			go m.handler.handleRequest(req.requestChannel, req.responseChannel, req.closeChannel)
 		}
-		req.requestChannel <- buffer
+		m.lock.Unlock()
+		// Outside the lock, closeListener needs it while this blocks
+		req.send(buffer)
 	}
         return nil
 }
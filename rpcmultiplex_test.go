@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Sends a request over a fresh connection and returns the response status
+// once the whole response arrived
+func pipeRequest(t *testing.T, handler RPCHandler, frames ...string) int {
+	conn, clientConn := net.Pipe()
+	defer conn.Close()
+	go NewRPCMultiplexer(clientConn, handler).Multiplex()
+	for _, frame := range frames {
+		WriteFrame(conn, 1, []byte(frame))
+	}
+	WriteFrame(conn, 1, DELIMITERBUFFER)
+	statuses := make(chan int, 1)
+	go func() {
+		status := 0
+		for {
+			_, buffer, err := ReadFrame(conn)
+			if err != nil || IsDelimiter(buffer) {
+				break
+			}
+			if status == 0 {
+				status = BytesToInt(buffer)
+			}
+		}
+		statuses <- status
+	}()
+	select {
+	case status := <-statuses:
+		return status
+	case <-time.After(5 * time.Second):
+		t.Fatal("No response")
+		return 0
+	}
+}
+
+func TestBodyCutOff(t *testing.T) {
+	root := filepath.FromSlash("/project")
+	fs := newMemoryFileSystem(root)
+	handler := NewRootedRPCHandler(root, ClientOptions{FileSystem: fs})
+	if status := pipeRequest(t, handler, "PUT /a.txt", "", "whole"); status != 200 {
+		t.Fatalf("PUT failed with %d", status)
+	}
+
+	conn, clientConn := net.Pipe()
+	go NewRPCMultiplexer(clientConn, handler).Multiplex()
+	WriteFrame(conn, 1, []byte("PUT /a.txt"))
+	WriteFrame(conn, 1, []byte(""))
+	WriteFrame(conn, 1, []byte("cut"))
+	conn.Close()
+
+	if status := pipeRequest(t, handler, "GET /a.txt", ""); status != 200 {
+		t.Errorf("GET after cut off PUT: %d", status)
+	}
+	if data, _ := readFile(fs, filepath.Join(root, "a.txt")); string(data) != "whole" {
+		t.Errorf("Cut off body written: %q", data)
+	}
+	if status := pipeRequest(t, handler, "PUT /a.txt", "", "again"); status != 200 {
+		t.Errorf("PUT after cut off PUT: %d", status)
+	}
+}
+
+// Answers right away without reading the request
+type hastyHandler struct {
+}
+
+func (hastyHandler) handleRequest(requestChannel chan []byte, responseChannel chan []byte, closeChannel chan bool) {
+	responseChannel <- statusCodeBuffer(200)
+	responseChannel <- headerBuffer(map[string]string{"Content-Length": "0"})
+	responseChannel <- DELIMITERBUFFER
+	closeChannel <- true
+}
+
+func TestUnreadRequestDoesNotBlock(t *testing.T) {
+	conn, clientConn := net.Pipe()
+	defer conn.Close()
+	go NewRPCMultiplexer(clientConn, hastyHandler{}).Multiplex()
+	go func() {
+		for {
+			if _, _, err := ReadFrame(conn); err != nil {
+				return
+			}
+		}
+	}()
+
+	// More than the handler's request channel holds
+	written := make(chan bool)
+	go func() {
+		for i := 0; i < 50; i++ {
+			WriteFrame(conn, 1, []byte("chunk"))
+		}
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection blocked by a finished request")
+	}
+}
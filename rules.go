@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// A single gitignore-style pattern
+type pathPattern struct {
+	pattern  string
+	regexp   *regexp.Regexp
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+func compilePathPattern(pattern string) *pathPattern {
+	pattern = strings.TrimRight(pattern, " \t\r")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return nil
+	}
+	p := &pathPattern{pattern: pattern}
+	if strings.HasPrefix(pattern, "!") {
+		p.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, "\\") {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		p.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if strings.Contains(pattern, "/") {
+		p.anchored = true
+		pattern = strings.TrimLeft(pattern, "/")
+	}
+	if pattern == "" {
+		return nil
+	}
+	expr := globToRegexp(pattern)
+	if !p.anchored {
+		expr = "(.*/)?" + expr
+	}
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return nil
+	}
+	p.regexp = re
+	return p
+}
+
+// Translates a glob with gitignore's ** semantics into a regular expression
+func globToRegexp(glob string) string {
+	var expr strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**/") {
+				expr.WriteString("(.*/)?")
+				i += 2
+			} else if strings.HasPrefix(glob[i:], "**") {
+				expr.WriteString(".*")
+				i++
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				expr.WriteString("\\[")
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.Replace(class, "\\", "\\\\", -1) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				expr.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return expr.String()
+}
+
+func (p *pathPattern) matches(relPath string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	return p.regexp.MatchString(relPath)
+}
+
+// The literal leading directories of an anchored pattern, used to decide
+// whether a directory may contain included paths
+func (p *pathPattern) literalPrefix() string {
+	prefix := p.pattern
+	if p.negate {
+		prefix = prefix[1:]
+	}
+	prefix = strings.TrimLeft(prefix, "/")
+	if i := strings.IndexAny(prefix, "*?[\\"); i != -1 {
+		prefix = prefix[:i]
+	}
+	return prefix
+}
+
+// An ordered list of patterns, where the last matching pattern wins, just
+// like in a .gitignore file. Patterns are relative to base.
+type ignoreList struct {
+	base     string
+	patterns []*pathPattern
+}
+
+func newIgnoreList(base string, patterns []string) *ignoreList {
+	list := &ignoreList{base: base}
+	for _, pattern := range patterns {
+		if p := compilePathPattern(pattern); p != nil {
+			list.patterns = append(list.patterns, p)
+		}
+	}
+	return list
+}
+
+// Reads a .gitignore style file, base is the directory it applies to
+func parseIgnoreFile(base string, r io.Reader) *ignoreList {
+	var patterns []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	return newIgnoreList(base, patterns)
+}
+
+// Reports whether relPath itself (ignoring its parents) is matched, and if
+// the last match was a negation
+func (l *ignoreList) match(relPath string, isDir bool) (matched bool, ignored bool) {
+	if l.base != "" {
+		if !strings.HasPrefix(relPath, l.base+"/") {
+			return false, false
+		}
+		relPath = relPath[len(l.base)+1:]
+	}
+	for i := len(l.patterns) - 1; i >= 0; i-- {
+		if l.patterns[i].matches(relPath, isDir) {
+			return true, !l.patterns[i].negate
+		}
+	}
+	return false, false
+}
+
+// Reports whether relPath or one of its parent directories is ignored
+func (l *ignoreList) ignores(relPath string, isDir bool) bool {
+	parts := strings.Split(relPath, "/")
+	for i := range parts {
+		partial := strings.Join(parts[:i+1], "/")
+		partialIsDir := isDir || i < len(parts)-1
+		if _, ignored := l.match(partial, partialIsDir); ignored {
+			return true
+		}
+	}
+	return false
+}
+
+// Include and exclude rules deciding which paths a session exposes.
+// Paths are slash separated and relative to the root.
+type PathRules struct {
+	include *ignoreList
+	exclude *ignoreList
+}
+
+func NewPathRules(include []string, exclude []string) *PathRules {
+	return &PathRules{
+		include: newIgnoreList("", include),
+		exclude: newIgnoreList("", exclude),
+	}
+}
+
+func (r *PathRules) IsHidden(relPath string, isDir bool) bool {
+	if r == nil {
+		return false
+	}
+	relPath = path.Clean(strings.Trim(relPath, "/"))
+	if relPath == "." {
+		return false
+	}
+	if r.exclude.ignores(relPath, isDir) {
+		return true
+	}
+	return !r.isIncluded(relPath, isDir)
+}
+
+func (r *PathRules) isIncluded(relPath string, isDir bool) bool {
+	if len(r.include.patterns) == 0 {
+		return true
+	}
+	// Included paths drag along everything below them
+	if r.include.ignores(relPath, isDir) {
+		return true
+	}
+	if !isDir {
+		return false
+	}
+	// Directories stay visible if they may lead to an included path
+	for _, p := range r.include.patterns {
+		if p.negate {
+			continue
+		}
+		if !p.anchored || strings.HasPrefix(p.literalPrefix(), relPath+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExcludeRules(t *testing.T) {
+	rules := NewPathRules(nil, []string{
+		".env",
+		"*.pem",
+		"/build/",
+		"node_modules/",
+		"secrets/**",
+		"!secrets/README",
+	})
+	cases := []struct {
+		path   string
+		isDir  bool
+		hidden bool
+	}{
+		{".env", false, true},
+		{"config/.env", false, true},
+		{"keys/server.pem", false, true},
+		{"build", true, true},
+		{"build/out.js", false, true},
+		{"src/build", true, false},
+		{"web/node_modules/lib/index.js", false, true},
+		{"secrets/key", false, true},
+		{"secrets/README", false, false},
+		{"src/main.go", false, false},
+		{"", true, false},
+	}
+	for _, c := range cases {
+		if rules.IsHidden(c.path, c.isDir) != c.hidden {
+			t.Errorf("IsHidden(%q) should be %v", c.path, c.hidden)
+		}
+	}
+}
+
+func TestIncludeRules(t *testing.T) {
+	rules := NewPathRules([]string{"/src/", "*.md"}, []string{"*_test.go"})
+	cases := []struct {
+		path   string
+		isDir  bool
+		hidden bool
+	}{
+		{"src", true, false},
+		{"src/main.go", false, false},
+		{"src/main_test.go", false, true},
+		{"README.md", false, false},
+		{"docs", true, false},
+		{"docs/intro.md", false, false},
+		{"Makefile", false, true},
+	}
+	for _, c := range cases {
+		if rules.IsHidden(c.path, c.isDir) != c.hidden {
+			t.Errorf("IsHidden(%q) should be %v", c.path, c.hidden)
+		}
+	}
+}
+
+func TestTransferKeepsHiddenPaths(t *testing.T) {
+	root := filepath.FromSlash("/project")
+	fs := newMemoryFileSystem(root)
+	fs.WriteFile(filepath.Join(root, "config/prod.key"), strings.NewReader("secret"))
+	fs.WriteFile(filepath.Join(root, "config/app.yml"), strings.NewReader("app"))
+	handler := NewRootedRPCHandler(root, ClientOptions{FileSystem: fs, Exclude: []string{"/config/prod.key"}})
+
+	if status, _ := testRequest(handler, "COPY /config", "Destination: /copied", ""); status != 201 {
+		t.Fatalf("COPY failed with %d", status)
+	}
+	if status, _ := testRequest(handler, "MOVE /config", "Destination: /moved", ""); status != 201 {
+		t.Fatalf("MOVE failed with %d", status)
+	}
+	for _, path := range []string{"copied/prod.key", "moved/prod.key"} {
+		if _, err := fs.Stat(filepath.Join(root, path)); err == nil {
+			t.Errorf("Hidden file transferred to %s", path)
+		}
+	}
+	if _, body := testRequest(handler, "GET /moved/app.yml", "", ""); body != "app" {
+		t.Errorf("Visible file not moved: %q", body)
+	}
+	if data, _ := readFile(fs, filepath.Join(root, "config/prod.key")); string(data) != "secret" {
+		t.Errorf("Hidden file not left in place: %q", data)
+	}
+}
+
+func TestSymlinksIntoHiddenPaths(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "secrets"), 0755)
+	os.MkdirAll(filepath.Join(root, "docs"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "secrets/prod.key"), []byte("secret"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "docs/readme.txt"), []byte("readme"), 0644)
+	ioutil.WriteFile(filepath.Join(outside, "other.txt"), []byte("other"), 0644)
+	os.Symlink("secrets", filepath.Join(root, "conf"))
+	os.Symlink("secrets/prod.key", filepath.Join(root, "key"))
+	os.Symlink("docs/readme.txt", filepath.Join(root, "readme"))
+	os.Symlink(outside, filepath.Join(root, "out"))
+	handler := NewRootedRPCHandler(root, ClientOptions{Exclude: []string{"secrets/"}})
+
+	for _, path := range []string{"/conf", "/conf/prod.key", "/key", "/out/other.txt"} {
+		if status, _ := testRequest(handler, "GET "+path, "", ""); status != 404 {
+			t.Errorf("GET %s through a symlink gave %d", path, status)
+		}
+	}
+	if status, _ := testRequest(handler, "PUT /conf/new.key", "", "new"); status != 404 {
+		t.Errorf("PUT through a symlink into a hidden directory gave %d", status)
+	}
+	if _, body := testRequest(handler, "GET /readme", "", ""); body != "readme" {
+		t.Errorf("Symlink to a visible file not followed: %q", body)
+	}
+	_, body := testRequest(handler, "POST /", "", "action=filelist&follow=true")
+	if strings.Contains(body, "prod.key") || strings.Contains(body, "/key\n") || strings.Contains(body, "other.txt") {
+		t.Errorf("Hidden files listed through symlinks: %q", body)
+	}
+	if !strings.Contains(body, "/readme\n") {
+		t.Errorf("Symlink to a visible file not listed: %q", body)
+	}
+}
+
+func TestDeleteKeepsHiddenPaths(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"config", "keys", "other"} {
+		os.MkdirAll(filepath.Join(root, dir), 0755)
+		ioutil.WriteFile(filepath.Join(root, dir, "prod.key"), []byte("secret"), 0644)
+		ioutil.WriteFile(filepath.Join(root, dir, "app.yml"), []byte("app"), 0644)
+	}
+	handler := NewRootedRPCHandler(root, ClientOptions{Trash: true, Exclude: []string{"*.key"}})
+
+	if status, _ := testRequest(handler, "DELETE /config?recursive=true", "", ""); status != 200 {
+		t.Fatalf("DELETE failed with %d", status)
+	}
+	if status, _ := testRequest(handler, "DELETE /keys?recursive=true&permanent=true", "", ""); status != 200 {
+		t.Fatalf("Permanent DELETE failed with %d", status)
+	}
+	for _, dir := range []string{"config", "keys"} {
+		if _, err := os.Stat(filepath.Join(root, dir, "app.yml")); err == nil {
+			t.Errorf("Visible file in %s not deleted", dir)
+		}
+		if data, _ := ioutil.ReadFile(filepath.Join(root, dir, "prod.key")); string(data) != "secret" {
+			t.Errorf("Hidden file in %s deleted", dir)
+		}
+	}
+	if _, body := testRequest(handler, "POST /", "", "action=trash-list"); !strings.Contains(body, `"/config"`) {
+		t.Errorf("Deleted directory not in the trash: %s", body)
+	}
+	if status, _ := testRequest(handler, "MOVE /other", "Destination: /config", ""); status != 403 {
+		t.Errorf("MOVE over a directory with hidden paths gave %d", status)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(root, "config/prod.key")); string(data) != "secret" {
+		t.Errorf("Hidden file replaced")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const SEARCH_DEFAULT_MAX_RESULTS = 1000
+
+// Files larger than this are not searched
+const SEARCH_MAX_FILE_SIZE = 10 * 1024 * 1024
+
+// Longer matching lines, e.g. in minified files, are cut down to this many
+// bytes around the match
+const SEARCH_MAX_LINE_LENGTH = 1000
+
+// Builds the regular expression for a search. Case can be "sensitive",
+// "insensitive" or "smart" (the default), where smart is insensitive unless
+// the query contains an upper case character.
+func compileSearchQuery(query string, isRegexp bool, caseMode string) (*regexp.Regexp, error) {
+	expr := query
+	if !isRegexp {
+		expr = regexp.QuoteMeta(query)
+	}
+	insensitive := caseMode == "insensitive"
+	if caseMode == "" || caseMode == "smart" {
+		insensitive = true
+		for _, r := range query {
+			if unicode.IsUpper(r) {
+				insensitive = false
+				break
+			}
+		}
+	}
+	if insensitive {
+		expr = "(?i)" + expr
+	}
+	return regexp.Compile(expr)
+}
+
+func isBinary(reader *bufio.Reader) bool {
+	header, _ := reader.Peek(8000)
+	return bytes.IndexByte(header, 0) != -1
+}
+
+type searcher struct {
+	re         *regexp.Regexp
+	walker     *fileWalker
+	streamer   *lineStreamer
+	maxResults int
+
+	lock  sync.Mutex
+	count int
+}
+
+// Counts a match, returns false once the maximum number of results is reached
+func (s *searcher) countMatch() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.count >= s.maxResults {
+		return false
+	}
+	s.count++
+	if s.count == s.maxResults {
+		s.walker.Stop()
+	}
+	return true
+}
+
+func (s *searcher) searchFile(relPath string, absPath string) {
+	f, err := s.walker.handler.fs.Open(absPath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	reader := bufio.NewReaderSize(f, 8192)
+	if isBinary(reader) {
+		return
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, BUFFER_SIZE), 1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		if s.walker.isStopped() {
+			return
+		}
+		lineNumber++
+		line := scanner.Text()
+		loc := s.re.FindStringIndex(line)
+		if loc == nil {
+			continue
+		}
+		if !s.countMatch() {
+			return
+		}
+		column := utf8.RuneCountInString(line[:loc[0]]) + 1
+		s.streamer.WriteLine(fmt.Sprintf("/%s:%d:%d:%s", relPath, lineNumber, column, matchText(line, loc[0])))
+	}
+}
+
+// The part of line around the match at start, at most SEARCH_MAX_LINE_LENGTH
+// bytes and cut at character boundaries
+func matchText(line string, start int) string {
+	if len(line) <= SEARCH_MAX_LINE_LENGTH {
+		return line
+	}
+	from := start - SEARCH_MAX_LINE_LENGTH/2
+	if from < 0 {
+		from = 0
+	}
+	to := from + SEARCH_MAX_LINE_LENGTH
+	if to > len(line) {
+		to = len(line)
+	}
+	for from > 0 && !utf8.RuneStart(line[from]) {
+		from++
+	}
+	for to < len(line) && !utf8.RuneStart(line[to]) {
+		to--
+	}
+	return line[from:to]
+}
+
+// Searches all files below dirPath, streaming matches as path:line:column:text
+// lines. Options in the POST body: query, regex=true, case, include and
+// exclude globs, max, plus the filelist walk options.
+func (self *RootedRPCHandler) handleSearch(dirPath string, queryValues url.Values, requestChannel chan []byte, responseChannel chan []byte) HttpError {
+	query := queryValues.Get("query")
+	if query == "" {
+		return NewHttpError(http.StatusBadRequest, "No query")
+	}
+	re, err := compileSearchQuery(query, queryValues.Get("regex") == "true", queryValues.Get("case"))
+	if err != nil {
+		return NewHttpError(http.StatusBadRequest, "Invalid regular expression: "+err.Error())
+	}
+	maxResults, err := strconv.Atoi(queryValues.Get("max"))
+	if err != nil || maxResults <= 0 {
+		maxResults = SEARCH_DEFAULT_MAX_RESULTS
+	}
+	var include *ignoreList
+	if len(queryValues["include"]) > 0 {
+		include = newIgnoreList("", queryValues["include"])
+	}
+
+	walker := newFileWalker(self, dirPath, parseWalkOptions(queryValues, self.walkExcludes))
+	streamer := &lineStreamer{responseChannel: responseChannel}
+	s := &searcher{
+		re:         re,
+		walker:     walker,
+		streamer:   streamer,
+		maxResults: maxResults,
+	}
+	walker.emit = func(relPath string, absPath string, f os.FileInfo) {
+		if f.Size() > SEARCH_MAX_FILE_SIZE {
+			return
+		}
+		if include != nil && !include.ignores(relPath, false) {
+			return
+		}
+		s.searchFile(relPath, absPath)
+	}
+	cancelled := cancelNotifier(requestChannel)
+	go func() {
+		<-cancelled
+		walker.Stop()
+	}()
+
+	responseChannel <- statusCodeBuffer(200)
+	responseChannel <- headerBuffer(map[string]string{
+		"Content-Type": "text/plain",
+	})
+	walker.Walk()
+	streamer.Flush()
+	return nil
+}
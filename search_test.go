@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	root := filepath.FromSlash("/project")
+	fs := newMemoryFileSystem(root)
+	minified := strings.Repeat("x", 70*1024) + "needle" + strings.Repeat("y", 70*1024)
+	fs.WriteFile(filepath.Join(root, "app.min.js"), strings.NewReader(minified+"\n"))
+	fs.WriteFile(filepath.Join(root, "notes.txt"), strings.NewReader("nothing\nfind the Needle here\n"))
+	handler := NewRootedRPCHandler(root, ClientOptions{FileSystem: fs})
+
+	requestChannel := make(chan []byte, 10)
+	responseChannel := make(chan []byte, 1000)
+	requestChannel <- []byte("POST /")
+	requestChannel <- []byte("")
+	requestChannel <- []byte("action=search&query=needle")
+	requestChannel <- DELIMITERBUFFER
+	handler.handleRequest(requestChannel, responseChannel, make(chan bool, 1))
+	close(responseChannel)
+	if status := BytesToInt(<-responseChannel); status != 200 {
+		t.Fatalf("Search failed with %d", status)
+	}
+	<-responseChannel
+	var body string
+	for buffer := range responseChannel {
+		if IsDelimiter(buffer) {
+			break
+		}
+		// Longer buffers don't fit in a multiplexer frame
+		if len(buffer) > BUFFER_SIZE {
+			t.Errorf("Buffer of %d bytes sent", len(buffer))
+		}
+		body += string(buffer)
+	}
+
+	results := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		parts := strings.SplitN(line, ":", 4)
+		if len(parts) != 4 {
+			t.Fatalf("Unexpected result line %q", line)
+		}
+		results[parts[0]+":"+parts[1]+":"+parts[2]] = parts[3]
+	}
+	if text := results["/notes.txt:2:10"]; text != "find the Needle here" {
+		t.Errorf("Unexpected match in notes.txt: %q", text)
+	}
+	text, ok := results["/app.min.js:1:71681"]
+	if !ok || len(text) > SEARCH_MAX_LINE_LENGTH || !strings.Contains(text, "needle") {
+		t.Errorf("Unexpected match in app.min.js of %d bytes", len(text))
+	}
+	if len(results) != 2 {
+		t.Errorf("Unexpected results: %v", results)
+	}
+}
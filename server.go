@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"net/http"
+	"net/url"
 	"fmt"
 	"flag"
 	"time"
@@ -11,6 +12,12 @@ import (
 	"encoding/json"
 	"golang.org/x/net/websocket"
 	"runtime"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
 )
 
 type NoSuchClientError struct {
@@ -21,6 +28,15 @@ func (e *NoSuchClientError) Error() string {
 	return fmt.Sprintf("No such client connected: %s", e.uuid)
 }
 
+// The client lost its connection and didn't come back within the grace period
+type ReconnectingError struct {
+	uuid string
+}
+
+func (e *ReconnectingError) Error() string {
+	return fmt.Sprintf("Client is reconnecting: %s", e.uuid)
+}
+
 type WebFSHandler struct {
 }
 
@@ -32,48 +48,75 @@ func quietPanicRecover() {
 
 func (self *WebFSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	parts := strings.Split(r.URL.Path, "/")
+	parts := strings.Split(r.URL.EscapedPath(), "/")
 	id := parts[0]
 
 	defer quietPanicRecover()
 
-	req, err := NewClientRequest(id)
-
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusGone)
-		return
+	if destination := r.Header.Get("Destination"); destination != "" {
+		path, err := rewriteDestination(destination, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		r.Header.Set("Destination", path)
 	}
-	// First send request line
+
 	requestLine := fmt.Sprintf("%s %s", r.Method, "/" + strings.Join(parts[1:], "/"))
+	if r.URL.RawQuery != "" {
+		requestLine += "?" + r.URL.RawQuery
+	}
 	fmt.Println(requestLine)
-	req.ch <- []byte(requestLine)
-	// Then send headers
 	var headerBuffer bytes.Buffer
-	for h, v := range r.Header {
-		headerBuffer.Write([]byte(fmt.Sprintf("%s: %s\n", h, v)))
-	}
-	req.ch <- headerBuffer.Bytes()
-
-	// Send body
-	for {
-		buffer := make([]byte, BUFFER_SIZE)
-		n, _ := r.Body.Read(buffer)
-		if n == 0 {
-			break
+	for h, values := range r.Header {
+		for _, v := range values {
+			headerBuffer.Write([]byte(fmt.Sprintf("%s: %s\n", h, v)))
 		}
-		req.ch <- buffer[:n]
 	}
-	req.ch <- DELIMITERBUFFER
-	statusCodeBuffer, ok := <-req.ch
-	if !ok {
-		http.Error(w, "Connection closed", http.StatusInternalServerError)
-		return
+
+	// Requests without side effects are sent again when the connection to
+	// the client is lost before it answered, once it registered again
+	retry := retriedMethods[r.Method]
+	var body []byte
+	if retry {
+		body, _ = ioutil.ReadAll(r.Body)
 	}
-	statusCode := BytesToInt(statusCodeBuffer)
-	headersBuffer, ok := <-req.ch
-	if !ok {
-		http.Error(w, "Connection close", http.StatusInternalServerError)
-		return
+	var req *ClientRequest
+	var statusCode int
+	var headersBuffer []byte
+	for attempt := 0; ; attempt++ {
+		var err error
+		req, err = NewClientRequest(id, r.Context().Done())
+		if err != nil {
+			switch err.(type) {
+			case *NoSuchClientError:
+				http.Error(w, err.Error(), http.StatusGone)
+			case *ReconnectingError:
+				w.Header().Set("Retry-After", strconv.Itoa(RECONNECTING_RETRY_AFTER))
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			default:
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			}
+			return
+		}
+		var bodyReader io.Reader = r.Body
+		if retry {
+			bodyReader = bytes.NewReader(body)
+		}
+		if req.sendRequest(requestLine, headerBuffer.Bytes(), bodyReader) {
+			if statusCodeBuffer, ok := <-req.ch; ok {
+				if headersBuffer, ok = <-req.ch; ok {
+					statusCode = BytesToInt(statusCodeBuffer)
+					break
+				}
+			}
+		}
+		// NewClientRequest holds the retry until the client is back
+		if !retry || attempt >= MAX_REQUEST_RETRIES {
+			http.Error(w, "Connection closed", http.StatusInternalServerError)
+			return
+		}
+		fmt.Println("Retrying", requestLine)
 	}
 	headers := strings.Split(string(headersBuffer), "\n")
 	for _, header := range headers {
@@ -82,32 +125,94 @@ func (self *WebFSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(statusCode)
 
+	// Flush every buffer right away, some responses are long running streams
+	flusher, _ := w.(http.Flusher)
 	for {
-		buffer, ok := <-req.ch
-		if !ok {
-			w.Write([]byte("Connection closed"))
-			break
-		}
-		if IsDelimiter(buffer) {
-			break
-		}
-		_, err := w.Write(buffer)
-		if err != nil {
-			fmt.Println("Got error", err)
-			break
+		select {
+		case buffer, ok := <-req.ch:
+			if !ok {
+				w.Write([]byte("Connection closed"))
+				req.finish()
+				return
+			}
+			if IsDelimiter(buffer) {
+				req.finish()
+				return
+			}
+			_, err := w.Write(buffer)
+			if err != nil {
+				fmt.Println("Got error", err)
+				req.abandon()
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			req.abandon()
+			return
 		}
 	}
 }
 
+// Turns the Destination header of a MOVE or COPY, a URL pointing into the
+// same session, into a path relative to the client's root
+func rewriteDestination(destination string, id string) (string, error) {
+	destinationUrl, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+	prefix := "/fs/" + id
+	if destinationUrl.Path != prefix && !strings.HasPrefix(destinationUrl.Path, prefix+"/") {
+		return "", errors.New("Destination is not in the same session")
+	}
+	path := destinationUrl.Path[len(prefix):]
+	if path == "" {
+		path = "/"
+	}
+	return path, nil
+}
+
 var clients map[string]*Client = make(map[string]*Client)
+var clientsLock sync.Mutex
+
+// Closed and replaced whenever a client registers, wakes up awaitClient
+var clientRegistered = make(chan bool)
+
+// When the clients of sessions that lost their connection did so. Requests
+// are held for reconnectGrace, after that the held requests get 503 Service
+// Unavailable and the session is forgotten, see forgetSession.
+var reconnectingSessions = make(map[string]time.Time)
+var reconnectGrace = DEFAULT_RECONNECT_GRACE
+
+const DEFAULT_RECONNECT_GRACE = 30 * time.Second
+
+// Seconds until a request that timed out waiting for a reconnect is worth
+// retrying, by then the client is back or the session is gone (410)
+const RECONNECTING_RETRY_AFTER = 5
+
+// Ends the grace period of a session that lost its connection at
+// disconnected, unless it reconnected since
+func forgetSession(uuid string, disconnected time.Time) {
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+	if since, ok := reconnectingSessions[uuid]; ok && since.Equal(disconnected) {
+		delete(reconnectingSessions, uuid)
+	}
+}
 
 type Client struct {
 	currentRequestId byte
 	writeChannel chan []byte
 	pendingRequests []*ClientRequest
+	lock sync.Mutex
+	// Set before closing when another connection reclaimed the id
+	replaced bool
 }
 
 func (c *Client) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	for i := range(c.pendingRequests) {
 		if c.pendingRequests[i] != nil {
 			c.pendingRequests[i].close()
@@ -116,25 +221,177 @@ func (c *Client) close() {
 	close(c.writeChannel)
 }
 
+// Registers a client, closing the previous connection of a client that took
+// its id over again
 func NewClient(uuid string) *Client {
 	client := &Client {
 		writeChannel: make(chan []byte),
 		pendingRequests: make([]*ClientRequest, 255),
 	}
+	clientsLock.Lock()
+	previous := clients[uuid]
 	clients[uuid] = client
+	delete(reconnectingSessions, uuid)
+	close(clientRegistered)
+	clientRegistered = make(chan bool)
+	clientsLock.Unlock()
+	if previous != nil {
+		previous.replaced = true
+		previous.close()
+	}
 	return client
 }
 
+func lookupClient(uuid string) (*Client, bool) {
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+	client, ok := clients[uuid]
+	return client, ok
+}
+
+func isConnected(uuid string) bool {
+	_, ok := lookupClient(uuid)
+	return ok
+}
+
+func (c *Client) getRequest(requestId byte) *ClientRequest {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.pendingRequests[requestId]
+}
+
 type ClientRequest struct {
 	requestId byte
+	client *Client
 	// Reusing channel for reading and writing
 	ch chan []byte
+	// For bidirectional streams, see send
+	streamLock sync.Mutex
+	cancelled bool
 }
 
 func (cr *ClientRequest) close() {
 	close(cr.ch)
 }
 
+// Sends the request line, headers and body to the client, returns false when
+// the connection was lost meanwhile
+func (cr *ClientRequest) sendRequest(requestLine string, headers []byte, body io.Reader) (sent bool) {
+	defer func() {
+		if recover() != nil {
+			sent = false
+		}
+	}()
+	cr.ch <- []byte(requestLine)
+	cr.ch <- headers
+	for {
+		buffer := make([]byte, BUFFER_SIZE)
+		n, _ := body.Read(buffer)
+		if n == 0 {
+			break
+		}
+		cr.ch <- buffer[:n]
+	}
+	cr.ch <- DELIMITERBUFFER
+	return true
+}
+
+// Frees up the request id once the response has been read completely
+func (cr *ClientRequest) finish() {
+	cr.client.lock.Lock()
+	defer cr.client.lock.Unlock()
+	if cr.client.pendingRequests[cr.requestId] == cr {
+		cr.client.pendingRequests[cr.requestId] = nil
+	}
+}
+
+// Sends a message of a bidirectional stream to the client, after the request
+// itself was sent. Returns false once the stream was cancelled.
+func (cr *ClientRequest) send(buffer []byte) (sent bool) {
+	defer quietPanicRecover()
+	cr.streamLock.Lock()
+	defer cr.streamLock.Unlock()
+	if cr.cancelled {
+		return false
+	}
+	cr.client.writeChannel <- addRequestId(cr.requestId, buffer)
+	return true
+}
+
+// Sends a CANCEL for a bidirectional stream, once, nothing is sent with send
+// after it
+func (cr *ClientRequest) cancel() {
+	defer quietPanicRecover()
+	cr.streamLock.Lock()
+	defer cr.streamLock.Unlock()
+	if cr.cancelled {
+		return
+	}
+	cr.cancelled = true
+	cr.client.writeChannel <- addRequestId(cr.requestId, CANCELBUFFER)
+}
+
+// Tells the client to stop working on the request and drops the remainder
+// of its response, used when the HTTP client went away before the end
+func (cr *ClientRequest) abandon() {
+	go func() {
+		defer quietPanicRecover()
+		cr.client.writeChannel <- addRequestId(cr.requestId, CANCELBUFFER)
+	}()
+	go func() {
+		for {
+			buffer, ok := <-cr.ch
+			if !ok || IsDelimiter(buffer) {
+				break
+			}
+		}
+		cr.finish()
+	}()
+}
+
+// Methods of requests that are sent again after the connection to the client
+// was lost, and how often
+var retriedMethods = map[string]bool{
+	"GET":  true,
+	"HEAD": true,
+}
+
+const MAX_REQUEST_RETRIES = 3
+
+// Returns the client of a session. While the session is reconnecting this
+// waits until the client is back, the grace period is over or done is closed.
+func awaitClient(uuid string, done <-chan struct{}) (*Client, error) {
+	held := false
+	for {
+		clientsLock.Lock()
+		client, ok := clients[uuid]
+		disconnected, reconnecting := reconnectingSessions[uuid]
+		registered := clientRegistered
+		clientsLock.Unlock()
+		if ok {
+			return client, nil
+		}
+		remaining := time.Until(disconnected.Add(reconnectGrace))
+		if !reconnecting || remaining <= 0 {
+			if held {
+				// The grace period ran out while this request was held
+				return nil, &ReconnectingError{uuid}
+			}
+			return nil, &NoSuchClientError{uuid}
+		}
+		held = true
+		timeout := time.NewTimer(remaining)
+		select {
+		case <-registered:
+		case <-timeout.C:
+		case <-done:
+			timeout.Stop()
+			return nil, errors.New("Request cancelled")
+		}
+		timeout.Stop()
+	}
+}
+
 func addRequestId(requestId byte, buffer []byte) []byte {
 	newBuffer := make([]byte, len(buffer)+1)
 	newBuffer[0] = requestId
@@ -144,18 +401,34 @@ func addRequestId(requestId byte, buffer []byte) []byte {
 	return newBuffer
 }
 
-func NewClientRequest(uuid string) (*ClientRequest, error) {
-	client, ok := clients[uuid]
-	if !ok {
-		return nil, &NoSuchClientError{uuid}
+// Starts a request to the client of a session, see awaitClient
+func NewClientRequest(uuid string, done <-chan struct{}) (*ClientRequest, error) {
+	client, err := awaitClient(uuid, done)
+	if err != nil {
+		return nil, err
 	}
-	client.currentRequestId = (client.currentRequestId + 1) % 255
+	client.lock.Lock()
+	// Request id 0 is reserved for messages from the server itself, and ids
+	// of long running requests may still be in use
 	requestId := client.currentRequestId
+	for {
+		requestId = (requestId + 1) % 255
+		if requestId != 0 && client.pendingRequests[requestId] == nil {
+			break
+		}
+		if requestId == client.currentRequestId {
+			client.lock.Unlock()
+			return nil, errors.New("Too many concurrent requests")
+		}
+	}
+	client.currentRequestId = requestId
 	req := &ClientRequest {
 		requestId: requestId,
+		client: client,
 		ch: make(chan []byte),
 	}
 	client.pendingRequests[requestId] = req
+	client.lock.Unlock()
 
 	go func() {
 		defer quietPanicRecover()
@@ -168,7 +441,7 @@ func NewClientRequest(uuid string) (*ClientRequest, error) {
 			if !ok {
 				break
 			}
-			clients[uuid].writeChannel <- addRequestId(requestId, buffer)
+			client.writeChannel <- addRequestId(requestId, buffer)
 			if IsDelimiter(buffer) {
 				break
 			}
@@ -177,6 +450,83 @@ func NewClientRequest(uuid string) (*ClientRequest, error) {
 	return req, nil
 }
 
+// Starts a bidirectional stream on the client, returning once the client has
+// accepted it. Errors of the client are returned as the status code followed
+// by the message.
+func OpenClientStream(uuid string, requestLine string) (*ClientRequest, error) {
+	req, err := NewClientRequest(uuid, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.ch <- []byte(requestLine)
+	req.ch <- []byte{}
+	req.ch <- DELIMITERBUFFER
+	statusCodeBuffer, ok := <-req.ch
+	if !ok {
+		return nil, errors.New("Connection closed")
+	}
+	if _, ok := <-req.ch; !ok {
+		return nil, errors.New("Connection closed")
+	}
+	if statusCode := BytesToInt(statusCodeBuffer); statusCode != http.StatusOK {
+		message := fmt.Sprintf("%d", statusCode)
+		for {
+			buffer, ok := <-req.ch
+			if !ok || IsDelimiter(buffer) {
+				break
+			}
+			message += " " + string(buffer)
+		}
+		req.finish()
+		return nil, errors.New(message)
+	}
+	return req, nil
+}
+
+// Relays the messages of a bidirectional stream on the client as binary
+// websocket messages, unchanged. An error opening the stream is sent as an
+// end message.
+func relayStreamWebsocket(ws *websocket.Conn, uuid string, requestLine string) {
+	req, err := OpenClientStream(uuid, requestLine)
+	if err != nil {
+		websocket.Message.Send(ws, streamMessage(STREAM_END, []byte(err.Error())))
+		return
+	}
+
+	// Input is forwarded until the client ends the stream or the editor goes
+	// away, both end with a single CANCEL so no input follows the end of the
+	// request
+	go func() {
+		for {
+			var message []byte
+			if err := websocket.Message.Receive(ws, &message); err != nil {
+				break
+			}
+			for len(message) > 0 && message[0] == STREAM_DATA && len(message) > BUFFER_SIZE {
+				if !req.send(message[:BUFFER_SIZE]) {
+					return
+				}
+				message = append([]byte{STREAM_DATA}, message[BUFFER_SIZE:]...)
+			}
+			if len(message) > 0 && !req.send(message) {
+				return
+			}
+		}
+		req.cancel()
+	}()
+	for {
+		buffer, ok := <-req.ch
+		if !ok || IsDelimiter(buffer) {
+			break
+		}
+		if len(buffer) > 0 && buffer[0] == STREAM_END {
+			req.cancel()
+		}
+		websocket.Message.Send(ws, buffer)
+	}
+	req.finish()
+}
+
 func socketServer(ws *websocket.Conn) {
 	defer ws.Close()
 	buffer := make([]byte, BUFFER_SIZE)
@@ -187,17 +537,31 @@ func socketServer(ws *websocket.Conn) {
 		fmt.Println("Could not parse welcome message.")
 		return
 	}
+	if err := authenticateHello(hello); err != nil {
+		fmt.Println("Client", hello.UUID, "refused:", err)
+		WriteFrame(ws, 0, []byte(SESSION_TAKEN))
+		return
+	}
 	fmt.Println("Client", hello.UUID, "connected")
 
 	client := NewClient(hello.UUID)
 
 	closeSocket := func() {
-		client, ok := clients[hello.UUID];
-		if ok {
+		clientsLock.Lock()
+		current := clients[hello.UUID] == client
+		if current {
+			delete(clients, hello.UUID)
+			if reconnectGrace > 0 {
+				now := time.Now()
+				reconnectingSessions[hello.UUID] = now
+				time.AfterFunc(reconnectGrace, func() { forgetSession(hello.UUID, now) })
+			}
+		}
+		clientsLock.Unlock()
+		if current {
 			fmt.Println("Client disconnected", hello.UUID)
 			client.close()
-			delete(clients, hello.UUID)
-		} // else was already closed before
+		} // else was already closed before, or replaced by a reconnect
 	}
 
 	defer closeSocket()
@@ -212,7 +576,7 @@ func socketServer(ws *websocket.Conn) {
 				closeSocket()
 				return
 			}
-			req := client.pendingRequests[requestId]
+			req := client.getRequest(requestId)
 			if req == nil {
 				fmt.Println("Got response for non-existent request", requestId, string(buffer))
 				continue
@@ -221,7 +585,7 @@ func socketServer(ws *websocket.Conn) {
 		}
 	}()
 
-	if hello.UserKey != "" {
+	if hello.UserKey != "" && !hello.Reconnect {
                 err := GetEditorClientChannel(hello.UserKey).Send(hello.UUID)
                 if err != nil {
                         err = WriteFrame(ws, 0, []byte(err.Error()))
@@ -233,6 +597,9 @@ func socketServer(ws *websocket.Conn) {
 	for {
 		writeBuffer, request_ok := <-client.writeChannel
 		if !request_ok {
+			if client.replaced {
+				WriteFrame(ws, 0, []byte(SESSION_REPLACED))
+			}
 			return
 		}
 		err = WriteFrame(ws, writeBuffer[0], writeBuffer[1:])
@@ -263,11 +630,20 @@ func PrintStats() {
 func ParseServerFlags(args []string) (ip string, port int, sslCrt string, sslKey string) {
 	var stats bool
 	config := ParseConfig()
+	if config.Server.ReconnectGrace != "" {
+		grace, err := time.ParseDuration(config.Server.ReconnectGrace)
+		if err != nil {
+			fmt.Println("Invalid reconnectgrace in ~/.zedremrc:", err)
+			os.Exit(4)
+		}
+		reconnectGrace = grace
+	}
 	flagSet := flag.NewFlagSet("zedrem", flag.ExitOnError)
 	flagSet.StringVar(&ip, "h", config.Server.Ip, "IP to bind to")
 	flagSet.IntVar(&port, "p", config.Server.Port, "Port to listen on")
 	flagSet.StringVar(&sslCrt, "sslcrt", config.Server.Sslcert, "Path to SSL certificate")
 	flagSet.StringVar(&sslKey, "sslkey", config.Server.Sslkey, "Path to SSL key")
+	flagSet.DurationVar(&reconnectGrace, "grace", reconnectGrace, "How long to hold requests for a client that lost its connection, 0 to fail them right away")
 	flagSet.BoolVar(&stats, "stats", false, "Whether to print go-routine count and memory usage stats periodically.")
 	flagSet.Parse(args)
 	if stats {
@@ -278,9 +654,15 @@ func ParseServerFlags(args []string) (ip string, port int, sslCrt string, sslKey
 }
 
 func RunServer(ip string, port int, sslCrt string, sslKey string, withSignaling bool) {
+	if err := loadSessionSecrets(os.ExpandEnv(SESSION_SECRETS_FILE)); err != nil {
+		fmt.Println("Could not read session secrets:", err)
+	}
 	http.Handle("/fs/", http.StripPrefix("/fs/", &WebFSHandler{}))
 	http.Handle("/clientsocket", websocket.Handler(socketServer))
 	http.Handle("/editorsocket", websocket.Handler(editorSocketServer))
+	http.Handle("/terminal/", websocket.Handler(terminalServer))
+	http.Handle("/lsp/", websocket.Handler(lspServer))
+	http.Handle("/fwd/", http.StripPrefix("/fwd/", &ForwardHandler{}))
 	if sslCrt != "" {
 		fmt.Printf("Zedrem server now running on wss://%s:%d\n", ip, port)
 		log.Fatal(http.ListenAndServeTLS(fmt.Sprintf("%s:%d", ip, port), sslCrt, sslKey, nil))
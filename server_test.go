@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"golang.org/x/net/websocket"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Reads requests without ever answering them
+type silentHandler struct {
+}
+
+func (silentHandler) handleRequest(requestChannel chan []byte, responseChannel chan []byte, closeChannel chan bool) {
+	for range requestChannel {
+	}
+}
+
+func connectTestClient(t *testing.T, server *httptest.Server, id string, handler RPCHandler) *websocket.Conn {
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/clientsocket", "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello, _ := json.Marshal(HelloMessage{Version: PROTOCOL_VERSION, UUID: id, Secret: "secret"})
+	ws.Write(hello)
+	go NewRPCMultiplexer(ws, handler).Multiplex()
+	return ws
+}
+
+// Waits until the client of the session is connected or gone
+func waitForConnection(t *testing.T, id string, connected bool) {
+	for i := 0; isConnected(id) != connected; i++ {
+		if i == 100 {
+			t.Fatalf("Client connected is not %v", connected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRetryAfterReconnect(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/fs/", http.StripPrefix("/fs/", &WebFSHandler{}))
+	mux.Handle("/clientsocket", websocket.Handler(socketServer))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	id := newSessionId()
+
+	ws := connectTestClient(t, server, id, silentHandler{})
+	waitForConnection(t, id, true)
+	responses := make(chan string)
+	go func() {
+		resp, err := http.Get(server.URL + "/fs/" + id + "/a.txt")
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		responses <- string(body)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	ws.Close()
+
+	root := filepath.FromSlash("/project")
+	fs := newMemoryFileSystem(root)
+	fs.WriteFile(filepath.Join(root, "a.txt"), strings.NewReader("retried"))
+	connectTestClient(t, server, id, NewRootedRPCHandler(root, ClientOptions{FileSystem: fs}))
+	select {
+	case response := <-responses:
+		if response != "retried" {
+			t.Errorf("Unexpected response: %q", response)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Request was not retried")
+	}
+}
+
+func TestGracePeriodExpires(t *testing.T) {
+	defer func(grace time.Duration) { reconnectGrace = grace }(reconnectGrace)
+	reconnectGrace = 200 * time.Millisecond
+	mux := http.NewServeMux()
+	mux.Handle("/fs/", http.StripPrefix("/fs/", &WebFSHandler{}))
+	mux.Handle("/clientsocket", websocket.Handler(socketServer))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	if resp, err := http.Get(server.URL + "/fs/" + newSessionId() + "/a.txt"); err != nil || resp.StatusCode != http.StatusGone {
+		t.Errorf("Unknown session not gone: %v %v", resp, err)
+	}
+
+	id := newSessionId()
+	ws := connectTestClient(t, server, id, silentHandler{})
+	waitForConnection(t, id, true)
+	ws.Close()
+	waitForConnection(t, id, false)
+	start := time.Now()
+	resp, err := http.Get(server.URL + "/fs/" + id + "/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "5" {
+		t.Errorf("Unexpected response after grace period: %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Errorf("Request was not held")
+	}
+	if resp, err := http.Get(server.URL + "/fs/" + id + "/a.txt"); err != nil || resp.StatusCode != http.StatusGone {
+		t.Errorf("Session not gone after grace period: %v %v", resp, err)
+	}
+}
+
+func TestEscapedPath(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/fs/", http.StripPrefix("/fs/", &WebFSHandler{}))
+	mux.Handle("/clientsocket", websocket.Handler(socketServer))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	id := newSessionId()
+
+	root := filepath.FromSlash("/project")
+	fs := newMemoryFileSystem(root)
+	fs.WriteFile(filepath.Join(root, "what?.txt"), strings.NewReader("question"))
+	fs.WriteFile(filepath.Join(root, "what"), strings.NewReader("wrong"))
+	connectTestClient(t, server, id, NewRootedRPCHandler(root, ClientOptions{FileSystem: fs}))
+	waitForConnection(t, id, true)
+	resp, err := http.Get(server.URL + "/fs/" + id + "/what%3F.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "question" {
+		t.Errorf("Unexpected response: %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestReconnectDoesNotNotifyEditor(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/clientsocket", websocket.Handler(socketServer))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, reconnect := range []bool{false, true} {
+		ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/clientsocket", "", server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := newSessionId()
+		hello, _ := json.Marshal(HelloMessage{Version: PROTOCOL_VERSION, UUID: id, UserKey: newSessionId(), Secret: "secret", Reconnect: reconnect})
+		ws.Write(hello)
+		stopped := make(chan error, 1)
+		go func() { stopped <- NewRPCMultiplexer(ws, silentHandler{}).Multiplex() }()
+		select {
+		case err := <-stopped:
+			if reconnect {
+				t.Errorf("Reconnecting client stopped: %s", err)
+			} else if err.Error() != "no-client" {
+				t.Errorf("Unexpected error without an editor: %s", err)
+			}
+		case <-time.After(500 * time.Millisecond):
+			if !reconnect {
+				t.Errorf("New client not told there is no editor")
+			}
+		}
+		ws.Close()
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pborman/uuid"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where -persist keeps session ids, one file per server URL and root
+const SESSIONS_DIR = "$HOME/.zedrem/sessions"
+
+// Where the server keeps the hashes of claimed session secrets, so that they
+// survive a restart
+const SESSION_SECRETS_FILE = "$HOME/.zedrem/session-secrets"
+
+// How long the server remembers the secret of a session nobody connected to
+const SESSION_SECRET_RETENTION = 30 * 24 * time.Hour
+
+// Sent by the server instead of accepting a client that may not use its id
+const SESSION_TAKEN = "session-taken"
+
+// Sent by the server to a client when another one reclaimed its id
+const SESSION_REPLACED = "session-replaced"
+
+type PersistedSession struct {
+	Url    string
+	Root   string
+	Id     string
+	Secret string
+}
+
+func newSessionId() string {
+	return strings.Replace(uuid.New(), "-", "", -1)
+}
+
+func newSessionSecret() string {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return hex.EncodeToString(secret)
+}
+
+// What identifies the served directories of a session, the absolute root or
+// all named roots
+func sessionRoot(options ClientOptions) string {
+	if len(options.Roots) == 0 {
+		rootPath, _ := filepath.Abs(options.RootPath)
+		return rootPath
+	}
+	roots := make([]string, len(options.Roots))
+	for i, root := range options.Roots {
+		rootPath, _ := filepath.Abs(root.Path)
+		roots[i] = root.Name + "=" + rootPath
+	}
+	return strings.Join(roots, " ")
+}
+
+// Returns the session for the server URL and root, creating and saving a new
+// one the first time
+func loadSession(options ClientOptions) (PersistedSession, error) {
+	session := PersistedSession{Url: options.Url, Root: sessionRoot(options)}
+	key := sha1.Sum([]byte(session.Url + "\n" + session.Root))
+	sessionFile := filepath.Join(os.ExpandEnv(SESSIONS_DIR), hex.EncodeToString(key[:]))
+	if content, err := ioutil.ReadFile(sessionFile); err == nil {
+		var saved PersistedSession
+		if err := json.Unmarshal(content, &saved); err == nil && saved.Id != "" && saved.Secret != "" {
+			return saved, nil
+		}
+	}
+	session.Id = newSessionId()
+	session.Secret = newSessionSecret()
+	if err := os.MkdirAll(filepath.Dir(sessionFile), 0700); err != nil {
+		return session, err
+	}
+	content, _ := json.MarshalIndent(session, "", "  ")
+	return session, ioutil.WriteFile(sessionFile, content, 0600)
+}
+
+type sessionSecret struct {
+	hash     [sha256.Size]byte
+	lastSeen time.Time
+}
+
+// How a sessionSecret is saved in the secrets file
+type savedSessionSecret struct {
+	Hash     string
+	LastSeen time.Time
+}
+
+// Hashes of the secrets clients first connected with, per session id
+var sessionSecrets = make(map[string]*sessionSecret)
+var sessionSecretsLock sync.Mutex
+
+// Where sessionSecrets are saved, not at all when empty
+var sessionSecretsFile string
+
+// Reads the secrets saved in secretsFile, if any, and saves them there from
+// now on
+func loadSessionSecrets(secretsFile string) error {
+	sessionSecretsLock.Lock()
+	defer sessionSecretsLock.Unlock()
+	sessionSecretsFile = secretsFile
+	content, err := ioutil.ReadFile(secretsFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var saved map[string]savedSessionSecret
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return err
+	}
+	for id, secret := range saved {
+		known := &sessionSecret{lastSeen: secret.LastSeen}
+		if hash, err := hex.DecodeString(secret.Hash); err == nil && len(hash) == sha256.Size {
+			copy(known.hash[:], hash)
+			sessionSecrets[id] = known
+		}
+	}
+	return nil
+}
+
+// Writes sessionSecrets to the secrets file, the lock must be held
+func saveSessionSecrets() {
+	if sessionSecretsFile == "" {
+		return
+	}
+	saved := make(map[string]savedSessionSecret)
+	for id, known := range sessionSecrets {
+		saved[id] = savedSessionSecret{hex.EncodeToString(known.hash[:]), known.lastSeen}
+	}
+	content, _ := json.MarshalIndent(saved, "", "  ")
+	err := os.MkdirAll(filepath.Dir(sessionSecretsFile), 0700)
+	if err == nil {
+		tempFile := sessionSecretsFile + ".tmp"
+		if err = ioutil.WriteFile(tempFile, content, 0600); err == nil {
+			err = os.Rename(tempFile, sessionSecretsFile)
+		}
+	}
+	if err != nil {
+		fmt.Println("Could not save session secrets:", err)
+	}
+}
+
+// Decides whether a client may use the id it said hello with. The first
+// secret seen for an id claims it, after that the id can only be used with
+// the same secret, which lets a client take its id over again after a
+// restart. Clients without a secret get an id only when nobody has it. The
+// hashes are saved when an id is claimed, see loadSessionSecrets, so this
+// holds across restarts of the server too.
+func authenticateHello(hello HelloMessage) error {
+	sessionSecretsLock.Lock()
+	defer sessionSecretsLock.Unlock()
+	now := time.Now()
+	for id, known := range sessionSecrets {
+		if now.Sub(known.lastSeen) > SESSION_SECRET_RETENTION && !isConnected(id) {
+			delete(sessionSecrets, id)
+		}
+	}
+
+	known := sessionSecrets[hello.UUID]
+	if hello.Secret == "" {
+		if known != nil || isConnected(hello.UUID) {
+			return errors.New("Session id is in use")
+		}
+		return nil
+	}
+	hash := sha256.Sum256([]byte(hello.Secret))
+	if known == nil {
+		if isConnected(hello.UUID) {
+			return errors.New("Session id is in use")
+		}
+		sessionSecrets[hello.UUID] = &sessionSecret{hash, now}
+		saveSessionSecrets()
+		return nil
+	}
+	if subtle.ConstantTimeCompare(known.hash[:], hash[:]) != 1 {
+		return errors.New("Wrong session secret")
+	}
+	known.lastSeen = now
+	return nil
+}
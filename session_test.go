@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthenticateHello(t *testing.T) {
+	id := newSessionId()
+	if err := authenticateHello(HelloMessage{UUID: id, Secret: "first"}); err != nil {
+		t.Fatalf("First secret refused: %s", err)
+	}
+	if err := authenticateHello(HelloMessage{UUID: id, Secret: "other"}); err == nil {
+		t.Errorf("Other secret accepted")
+	}
+	if err := authenticateHello(HelloMessage{UUID: id}); err == nil {
+		t.Errorf("Missing secret accepted")
+	}
+	if err := authenticateHello(HelloMessage{UUID: id, Secret: "first"}); err != nil {
+		t.Errorf("Same secret refused: %s", err)
+	}
+}
+
+func TestLoadSession(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	options := ClientOptions{Url: "wss://relay", RootPath: "/project"}
+	first, err := loadSession(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := loadSession(options); again != first {
+		t.Errorf("Session not kept: %v and %v", first, again)
+	}
+	options.Url = "wss://other"
+	if other, _ := loadSession(options); other.Id == first.Id {
+		t.Errorf("Same session for another server")
+	}
+}
+
+func TestSessionSecretsSurviveRestart(t *testing.T) {
+	secretsFile := filepath.Join(t.TempDir(), "session-secrets")
+	if err := loadSessionSecrets(secretsFile); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { sessionSecretsFile = "" }()
+	id := newSessionId()
+	if err := authenticateHello(HelloMessage{UUID: id, Secret: "first"}); err != nil {
+		t.Fatalf("First secret refused: %s", err)
+	}
+
+	// A restarted server only knows what was saved
+	sessionSecretsLock.Lock()
+	delete(sessionSecrets, id)
+	sessionSecretsLock.Unlock()
+	if err := loadSessionSecrets(secretsFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticateHello(HelloMessage{UUID: id, Secret: "other"}); err == nil {
+		t.Errorf("Other secret accepted after a restart")
+	}
+	if err := authenticateHello(HelloMessage{UUID: id, Secret: "first"}); err != nil {
+		t.Errorf("Same secret refused after a restart: %s", err)
+	}
+}
+
+func TestSessionSecretsSavedOnClaim(t *testing.T) {
+	secretsFile := filepath.Join(t.TempDir(), "session-secrets")
+	if err := loadSessionSecrets(secretsFile); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { sessionSecretsFile = "" }()
+	if err := authenticateHello(HelloMessage{UUID: newSessionId()}); err != nil {
+		t.Fatalf("Hello without a secret refused: %s", err)
+	}
+	if _, err := os.Stat(secretsFile); !os.IsNotExist(err) {
+		t.Errorf("Secrets saved for a hello without a secret")
+	}
+	id := newSessionId()
+	authenticateHello(HelloMessage{UUID: id, Secret: "first"})
+	if _, err := os.Stat(secretsFile); err != nil {
+		t.Fatalf("Claimed secret not saved: %s", err)
+	}
+	os.Remove(secretsFile)
+	if err := authenticateHello(HelloMessage{UUID: id, Secret: "first"}); err != nil {
+		t.Fatalf("Same secret refused: %s", err)
+	}
+	if _, err := os.Stat(secretsFile); !os.IsNotExist(err) {
+		t.Errorf("Secrets saved again on a reconnect")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// A terminal is a bidirectional stream (see STREAM_DATA) with an extra
+// message from the editor to resize the window:
+//
+//	'r' {"rows": n, "cols": n}
+//
+// The end message from the client carries the shell's exit status.
+const TERMINAL_RESIZE = 'r'
+
+type TerminalSize struct {
+	Rows int `json:"rows"`
+	Cols int `json:"cols"`
+}
+
+// Runs a shell in a pseudo terminal in the requested directory. Only allowed
+// when the client was started with -terminal.
+func (self *RootedRPCHandler) handleTerminal(req *rpcRequest, requestChannel chan []byte, responseChannel chan []byte) HttpError {
+	dropUntilDelimiter(requestChannel)
+	if !self.terminal {
+		return NewHttpError(http.StatusForbidden, "Terminals are disabled, start the client with -terminal")
+	}
+	dirPath, httpErr := self.resolvePath(req.path)
+	if httpErr != nil {
+		return httpErr
+	}
+	if stat, err := os.Stat(dirPath); err != nil || !stat.IsDir() {
+		return NewHttpError(http.StatusBadRequest, "Working directory is not a directory")
+	}
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	cmd := exec.Command(shell)
+	cmd.Dir = dirPath
+	cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+	master, err := startPty(cmd)
+	if err != nil {
+		return NewHttpError(http.StatusNotImplemented, "Could not start terminal: "+err.Error())
+	}
+	defer master.Close()
+	rows, _ := strconv.Atoi(req.query.Get("rows"))
+	cols, _ := strconv.Atoi(req.query.Get("cols"))
+	if rows > 0 && cols > 0 {
+		resizePty(master, rows, cols)
+	}
+
+	responseChannel <- statusCodeBuffer(200)
+	responseChannel <- headerBuffer(map[string]string{"Content-Type": "application/x-zedrem-terminal"})
+	exited := make(chan bool)
+	go func() {
+		for {
+			buffer := make([]byte, BUFFER_SIZE-1)
+			n, err := master.Read(buffer)
+			if n > 0 {
+				responseChannel <- streamMessage(STREAM_DATA, buffer[:n])
+			}
+			if err != nil {
+				break
+			}
+		}
+		exitCode := -1
+		if cmd.Wait() == nil {
+			exitCode = 0
+		} else if cmd.ProcessState != nil {
+			exitCode = cmd.ProcessState.ExitCode()
+		}
+		responseChannel <- streamMessage(STREAM_END, []byte(strconv.Itoa(exitCode)))
+		close(exited)
+	}()
+
+	for {
+		buffer, ok := <-requestChannel
+		if !ok || IsCancel(buffer) {
+			break
+		}
+		if len(buffer) == 0 {
+			continue
+		}
+		switch buffer[0] {
+		case STREAM_DATA:
+			master.Write(buffer[1:])
+		case TERMINAL_RESIZE:
+			var size TerminalSize
+			if json.Unmarshal(buffer[1:], &size) == nil && size.Rows > 0 && size.Cols > 0 {
+				resizePty(master, size.Rows, size.Cols)
+			}
+		}
+	}
+	// The shell leads its session's process group. Jobs in other groups may
+	// keep the terminal open, closing the master ends the read anyway.
+	killProcessGroup(cmd)
+	master.Close()
+	<-exited
+	return nil
+}
+
+// Relays a websocket at /terminal/<id>/<path>?rows=n&cols=n to a terminal on
+// the client
+func terminalServer(ws *websocket.Conn) {
+	defer ws.Close()
+	defer quietPanicRecover()
+	parts := strings.Split(strings.TrimPrefix(ws.Request().URL.EscapedPath(), "/terminal/"), "/")
+	requestLine := "TERMINAL /" + strings.Join(parts[1:], "/")
+	if ws.Request().URL.RawQuery != "" {
+		requestLine += "?" + ws.Request().URL.RawQuery
+	}
+	relayStreamWebsocket(ws, parts[0], requestLine)
+}
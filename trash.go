@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pborman/uuid"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Deleted files are moved here (relative to the root) instead of being
+// removed right away
+const TRASH_DIR = ".zedrem-trash"
+
+const DEFAULT_TRASH_RETENTION = 7 * 24 * time.Hour
+
+// Stored as info.json next to the trashed item
+type TrashEntry struct {
+	Id      string    `json:"id"`
+	Path    string    `json:"path"`
+	Type    string    `json:"type"`
+	Deleted time.Time `json:"deleted"`
+}
+
+// Keeps dir out of git status in the project it's in
+func ignoreInGit(dir string) {
+	path := filepath.Join(dir, ".gitignore")
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		ioutil.WriteFile(path, []byte("*\n"), 0600)
+	}
+}
+
+func (self *RootedRPCHandler) trashPath(parts ...string) string {
+	return filepath.Join(append([]string{self.rootPath, TRASH_DIR}, parts...)...)
+}
+
+// Moves absPath into a new trash entry that restores to originalPath, which
+// differs from absPath for a file that was moved aside first. Paths hidden by
+// the rules inside a directory stay where they are.
+func (self *RootedRPCHandler) moveToTrash(absPath string, originalPath string, isDir bool) error {
+	self.purgeExpiredTrash()
+	entry := TrashEntry{
+		Id:      fmt.Sprintf("%d-%s", time.Now().Unix(), uuid.New()[:8]),
+		Path:    "/" + self.relativePath(originalPath),
+		Type:    "file",
+		Deleted: time.Now(),
+	}
+	if isDir {
+		entry.Type = "directory"
+	}
+	if err := os.MkdirAll(self.trashPath(entry.Id), 0700); err != nil {
+		return err
+	}
+	ignoreInGit(self.trashPath())
+	info, _ := json.Marshal(entry)
+	if err := ioutil.WriteFile(self.trashPath(entry.Id, "info.json"), info, 0600); err != nil {
+		return err
+	}
+	if isDir && self.containsHidden(absPath) {
+		if err := self.copyVisible(absPath, self.trashPath(entry.Id, "item"), true); err != nil {
+			os.RemoveAll(self.trashPath(entry.Id))
+			return err
+		}
+		return self.removeVisible(absPath)
+	}
+	if err := moveTree(absPath, self.trashPath(entry.Id, "item")); err != nil {
+		os.RemoveAll(self.trashPath(entry.Id))
+		return err
+	}
+	return nil
+}
+
+func (self *RootedRPCHandler) readTrash() []TrashEntry {
+	dirs, _ := ioutil.ReadDir(self.trashPath())
+	entries := make([]TrashEntry, 0, len(dirs))
+	for _, dir := range dirs {
+		info, err := ioutil.ReadFile(self.trashPath(dir.Name(), "info.json"))
+		if err != nil {
+			continue
+		}
+		var entry TrashEntry
+		if json.Unmarshal(info, &entry) == nil && entry.Id == dir.Name() {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Deleted.After(entries[j].Deleted)
+	})
+	return entries
+}
+
+func (self *RootedRPCHandler) purgeExpiredTrash() {
+	if self.trashRetention <= 0 {
+		return
+	}
+	for _, entry := range self.readTrash() {
+		if time.Since(entry.Deleted) > self.trashRetention {
+			os.RemoveAll(self.trashPath(entry.Id))
+		}
+	}
+}
+
+func isValidTrashId(id string) bool {
+	return id != "" && !strings.ContainsAny(id, "/\\") && id != "." && id != ".."
+}
+
+// Actions: trash-list, trash-restore (id, overwrite=true) and trash-purge
+// (id, or everything when no id is given)
+func (self *RootedRPCHandler) handleTrash(action string, queryValues url.Values, responseChannel chan []byte) HttpError {
+	id := queryValues.Get("id")
+	switch action {
+	case "trash-list":
+		self.purgeExpiredTrash()
+		responseChannel <- statusCodeBuffer(200)
+		responseChannel <- headerBuffer(map[string]string{"Content-Type": "application/json"})
+		json.NewEncoder(&channelWriter{responseChannel}).Encode(self.readTrash())
+		return nil
+	case "trash-restore":
+		if !isValidTrashId(id) {
+			return NewHttpError(http.StatusBadRequest, "Invalid trash id")
+		}
+		info, err := ioutil.ReadFile(self.trashPath(id, "info.json"))
+		if err != nil {
+			return NewHttpError(http.StatusNotFound, "No such trash entry")
+		}
+		var entry TrashEntry
+		if err := json.Unmarshal(info, &entry); err != nil {
+			return NewHttpError(http.StatusInternalServerError, "Corrupt trash entry")
+		}
+		path := strings.TrimPrefix(entry.Path, "/")
+		destination, httpErr := self.resolvePath(path)
+		if httpErr != nil {
+			return httpErr
+		}
+		if !self.acquireWriteLock(path) {
+			return NewHttpError(http.StatusConflict, "Write already going on")
+		}
+		defer self.releaseWriteLock(path)
+		if stat, err := os.Lstat(destination); err == nil {
+			if queryValues.Get("overwrite") != "true" {
+				return NewHttpError(http.StatusConflict, "Path exists again, pass overwrite=true to replace it")
+			}
+			if stat.IsDir() && self.containsHidden(destination) {
+				return NewHttpError(http.StatusForbidden, "Cannot replace a directory with hidden paths in it")
+			}
+			// What is replaced goes to the trash in turn
+			if err := self.moveToTrash(destination, destination, stat.IsDir()); err != nil {
+				return fileError(err, "Could not replace existing file")
+			}
+		}
+		os.MkdirAll(filepath.Dir(destination), 0777)
+		if err := moveTree(self.trashPath(id, "item"), destination); err != nil {
+			return fileError(err, "Could not restore")
+		}
+		os.RemoveAll(self.trashPath(id))
+		responseChannel <- statusCodeBuffer(200)
+		responseChannel <- headerBuffer(map[string]string{"Content-Type": "text/plain"})
+		responseChannel <- []byte(entry.Path)
+		return nil
+	case "trash-purge":
+		var err error
+		if id == "" {
+			err = os.RemoveAll(self.trashPath())
+		} else if isValidTrashId(id) {
+			err = os.RemoveAll(self.trashPath(id))
+		} else {
+			return NewHttpError(http.StatusBadRequest, "Invalid trash id")
+		}
+		if err != nil {
+			return fileError(err, "Could not purge trash")
+		}
+		responseChannel <- statusCodeBuffer(200)
+		responseChannel <- headerBuffer(map[string]string{"Content-Type": "text/plain"})
+		responseChannel <- []byte("OK")
+		return nil
+	}
+	return NewHttpError(http.StatusNotImplemented, "No such action")
+}
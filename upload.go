@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/pborman/uuid"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Partial uploads are kept here (relative to the root) until committed
+const UPLOAD_DIR = ".zedrem-uploads"
+
+const DEFAULT_UPLOAD_EXPIRY = 24 * time.Hour
+
+// Stored as info.json next to the received data
+type UploadInfo struct {
+	Id      string    `json:"id"`
+	Path    string    `json:"path"`
+	Created time.Time `json:"created"`
+}
+
+func (self *RootedRPCHandler) uploadPath(parts ...string) string {
+	return filepath.Join(append([]string{self.rootPath, UPLOAD_DIR}, parts...)...)
+}
+
+// Removes uploads that haven't received data for longer than the expiry
+func (self *RootedRPCHandler) purgeExpiredUploads() {
+	if self.uploadExpiry <= 0 {
+		return
+	}
+	dirs, _ := ioutil.ReadDir(self.uploadPath())
+	for _, dir := range dirs {
+		stat, err := os.Stat(self.uploadPath(dir.Name(), "data"))
+		if err != nil || time.Since(stat.ModTime()) > self.uploadExpiry {
+			os.RemoveAll(self.uploadPath(dir.Name()))
+		}
+	}
+}
+
+func (self *RootedRPCHandler) readUpload(id string) (*UploadInfo, os.FileInfo, HttpError) {
+	if uuid.Parse(id) == nil {
+		return nil, nil, NewHttpError(http.StatusBadRequest, "Invalid upload id")
+	}
+	info, err := ioutil.ReadFile(self.uploadPath(id, "info.json"))
+	if err != nil {
+		return nil, nil, NewHttpError(http.StatusNotFound, "No such upload")
+	}
+	var upload UploadInfo
+	if err := json.Unmarshal(info, &upload); err != nil {
+		return nil, nil, NewHttpError(http.StatusInternalServerError, "Corrupt upload")
+	}
+	stat, err := os.Stat(self.uploadPath(id, "data"))
+	if err != nil {
+		return nil, nil, NewHttpError(http.StatusNotFound, "No such upload")
+	}
+	return &upload, stat, nil
+}
+
+func sendUploadOffset(responseChannel chan []byte, status int, offset int64) {
+	responseChannel <- statusCodeBuffer(status)
+	responseChannel <- headerBuffer(map[string]string{
+		"Content-Type":    "text/plain",
+		"X-Upload-Offset": strconv.FormatInt(offset, 10),
+	})
+	responseChannel <- []byte(strconv.FormatInt(offset, 10))
+}
+
+// PUT ?upload=<id>&offset=<n> appends a chunk to an upload. The offset has to
+// match the number of bytes received so far, otherwise nothing is written and
+// 409 Conflict is returned along with the current offset.
+func (self *RootedRPCHandler) handleUploadChunk(req *rpcRequest, requestChannel chan []byte, responseChannel chan []byte) HttpError {
+	id := req.query.Get("upload")
+	if !self.acquireWriteLock(UPLOAD_DIR + "/" + id) {
+		dropUntilDelimiter(requestChannel)
+		return NewHttpError(http.StatusConflict, "Upload of this chunk already going on")
+	}
+	defer self.releaseWriteLock(UPLOAD_DIR + "/" + id)
+
+	_, stat, httpErr := self.readUpload(id)
+	if httpErr != nil {
+		dropUntilDelimiter(requestChannel)
+		return httpErr
+	}
+	offset, err := strconv.ParseInt(req.query.Get("offset"), 10, 64)
+	if err != nil {
+		dropUntilDelimiter(requestChannel)
+		return NewHttpError(http.StatusBadRequest, "Invalid offset")
+	}
+	if offset != stat.Size() {
+		dropUntilDelimiter(requestChannel)
+		sendUploadOffset(responseChannel, http.StatusConflict, stat.Size())
+		return nil
+	}
+	f, err := os.OpenFile(self.uploadPath(id, "data"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		dropUntilDelimiter(requestChannel)
+		return fileError(err, "Could not open upload")
+	}
+	body := &channelReader{requestChannel: requestChannel}
+	_, err = io.Copy(f, body)
+	body.drain()
+	f.Sync()
+	f.Close()
+	if err != nil {
+		// Drop the partial chunk so the client can resend it
+		os.Truncate(self.uploadPath(id, "data"), offset)
+		if err == io.ErrUnexpectedEOF {
+			return NewHttpError(http.StatusBadRequest, "Chunk cut off")
+		}
+		return NewHttpError(http.StatusInternalServerError, "Could not write to upload")
+	}
+	stat, _ = os.Stat(self.uploadPath(id, "data"))
+	sendUploadOffset(responseChannel, http.StatusOK, stat.Size())
+	return nil
+}
+
+// Actions: upload-create, upload-status (id), upload-commit (id, and
+// optionally size to check the received size against) and upload-cancel (id)
+func (self *RootedRPCHandler) handleUpload(action string, req *rpcRequest, absPath string, queryValues url.Values, responseChannel chan []byte) HttpError {
+	id := queryValues.Get("id")
+	if action == "upload-create" {
+		self.purgeExpiredUploads()
+		if stat, err := os.Stat(absPath); err == nil && stat.IsDir() {
+			return NewHttpError(http.StatusConflict, "Path is a directory")
+		}
+		upload := UploadInfo{
+			Id:      uuid.New(),
+			Path:    "/" + self.relativePath(absPath),
+			Created: time.Now(),
+		}
+		if err := os.MkdirAll(self.uploadPath(upload.Id), 0700); err != nil {
+			return fileError(err, "Could not create upload")
+		}
+		info, _ := json.Marshal(upload)
+		if err := ioutil.WriteFile(self.uploadPath(upload.Id, "info.json"), info, 0600); err != nil {
+			os.RemoveAll(self.uploadPath(upload.Id))
+			return fileError(err, "Could not create upload")
+		}
+		if err := ioutil.WriteFile(self.uploadPath(upload.Id, "data"), nil, 0600); err != nil {
+			os.RemoveAll(self.uploadPath(upload.Id))
+			return fileError(err, "Could not create upload")
+		}
+		responseChannel <- statusCodeBuffer(http.StatusCreated)
+		responseChannel <- headerBuffer(map[string]string{
+			"Content-Type": "text/plain",
+			"X-Upload-Id":  upload.Id,
+		})
+		responseChannel <- []byte(upload.Id)
+		return nil
+	}
+
+	upload, stat, httpErr := self.readUpload(id)
+	if httpErr != nil {
+		return httpErr
+	}
+	if upload.Path != "/"+self.relativePath(absPath) {
+		return NewHttpError(http.StatusConflict, "Upload belongs to "+upload.Path)
+	}
+	switch action {
+	case "upload-status":
+		sendUploadOffset(responseChannel, http.StatusOK, stat.Size())
+		return nil
+	case "upload-cancel":
+		os.RemoveAll(self.uploadPath(id))
+		responseChannel <- statusCodeBuffer(200)
+		responseChannel <- headerBuffer(map[string]string{"Content-Type": "text/plain"})
+		responseChannel <- []byte("OK")
+		return nil
+	case "upload-commit":
+		if size := queryValues.Get("size"); size != "" && size != strconv.FormatInt(stat.Size(), 10) {
+			sendUploadOffset(responseChannel, http.StatusConflict, stat.Size())
+			return nil
+		}
+		if !self.acquireWriteLock(UPLOAD_DIR + "/" + id) {
+			return NewHttpError(http.StatusConflict, "Upload of a chunk going on")
+		}
+		defer self.releaseWriteLock(UPLOAD_DIR + "/" + id)
+		if !self.acquireWriteLock(req.path) {
+			return NewHttpError(http.StatusConflict, "Write already going on")
+		}
+		defer self.releaseWriteLock(req.path)
+		os.MkdirAll(filepath.Dir(absPath), 0777)
+		// The data is moved next to the target first, so it's committed the
+		// same way as a regular PUT
+		tempPath := newTempPath(absPath)
+		if err := moveTree(self.uploadPath(id, "data"), tempPath); err != nil {
+			return fileError(err, "Could not commit upload")
+		}
+		if httpErr := self.commitTempFile(tempPath, absPath); httpErr != nil {
+			// Put the data back, so the commit can be tried again
+			if moveTree(tempPath, self.uploadPath(id, "data")) != nil {
+				os.Remove(tempPath)
+			}
+			return httpErr
+		}
+		os.RemoveAll(self.uploadPath(id))
+		stat, _ := os.Stat(absPath)
+		responseChannel <- statusCodeBuffer(200)
+		responseChannel <- headerBuffer(map[string]string{
+			"Content-Type": "text/plain",
+			"ETag":         stat.ModTime().String(),
+		})
+		responseChannel <- []byte("OK")
+		return nil
+	}
+	return NewHttpError(http.StatusNotImplemented, "No such action")
+}
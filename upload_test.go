@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResumeCutOffChunk(t *testing.T) {
+	root := t.TempDir()
+	handler := NewRootedRPCHandler(root, ClientOptions{})
+	status, id := testRequest(handler, "POST /big.bin", "", "action=upload-create")
+	if status != 201 {
+		t.Fatalf("Could not create upload: %d", status)
+	}
+	if status := pipeRequest(t, handler, "PUT /big.bin?upload="+id+"&offset=0", "", "first "); status != 200 {
+		t.Fatalf("First chunk failed with %d", status)
+	}
+
+	conn, clientConn := net.Pipe()
+	go NewRPCMultiplexer(clientConn, handler).Multiplex()
+	WriteFrame(conn, 1, []byte("PUT /big.bin?upload="+id+"&offset=6"))
+	WriteFrame(conn, 1, []byte(""))
+	WriteFrame(conn, 1, []byte("cut"))
+	conn.Close()
+
+	// The cut off chunk is given up on in the background
+	status = pipeRequest(t, handler, "PUT /big.bin?upload="+id+"&offset=6", "", "second")
+	for i := 0; status == 409 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		status = pipeRequest(t, handler, "PUT /big.bin?upload="+id+"&offset=6", "", "second")
+	}
+	if status != 200 {
+		t.Fatalf("Resumed chunk failed with %d", status)
+	}
+	if status, _ := testRequest(handler, "POST /big.bin", "", "action=upload-commit&id="+id); status != 200 {
+		t.Fatalf("Commit failed with %d", status)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(root, "big.bin")); string(data) != "first second" {
+		t.Errorf("Unexpected upload: %q", data)
+	}
+}
+
+func TestRetryFailedCommit(t *testing.T) {
+	root := t.TempDir()
+	handler := NewRootedRPCHandler(root, ClientOptions{})
+	_, id := testRequest(handler, "POST /big.bin", "", "action=upload-create")
+	if status := pipeRequest(t, handler, "PUT /big.bin?upload="+id+"&offset=0", "", "data"); status != 200 {
+		t.Fatalf("Chunk failed with %d", status)
+	}
+
+	// A directory in the way makes the commit fail
+	os.MkdirAll(filepath.Join(root, "big.bin", "sub"), 0777)
+	if status, _ := testRequest(handler, "POST /big.bin", "", "action=upload-commit&id="+id); status == 200 {
+		t.Fatalf("Commit over a directory succeeded")
+	}
+	os.RemoveAll(filepath.Join(root, "big.bin"))
+	if status, body := testRequest(handler, "POST /big.bin", "", "action=upload-commit&id="+id); status != 200 {
+		t.Fatalf("Commit failed again with %d: %s", status, body)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(root, "big.bin")); string(data) != "data" {
+		t.Errorf("Unexpected upload: %q", data)
+	}
+}
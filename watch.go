@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How often the tree is rescanned when no native file watching is available
+const WATCH_POLL_INTERVAL = 2 * time.Second
+
+type WatchEvent struct {
+	Type string `json:"type"` // create, modify, delete or rename
+	Path string `json:"path"`
+	From string `json:"from,omitempty"` // Previous path for renames
+}
+
+// Decides whether a path (and for directories, everything below it) should
+// be left out of watching
+type watchFilter func(absPath string, isDir bool) bool
+
+// Emits events for all changes below root until done is closed, paths in
+// events are absolute
+func watchTree(root string, skip watchFilter, done chan bool) (chan WatchEvent, error) {
+	events, err := nativeWatchTree(root, skip, done)
+	if err != nil {
+		return pollTree(root, skip, done)
+	}
+	return events, nil
+}
+
+type pollEntry struct {
+	modTime time.Time
+	size    int64
+	isDir   bool
+}
+
+func scanTree(root string, skip watchFilter) map[string]pollEntry {
+	entries := make(map[string]pollEntry)
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != root && skip(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		entries[path] = pollEntry{info.ModTime(), info.Size(), info.IsDir()}
+		return nil
+	})
+	return entries
+}
+
+// Fallback watcher that periodically rescans the tree and diffs it with the
+// previous scan. A file disappearing while another one with the same size
+// and modification time appears is reported as a rename.
+func pollTree(root string, skip watchFilter, done chan bool) (chan WatchEvent, error) {
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+	events := make(chan WatchEvent)
+	go func() {
+		defer close(events)
+		previous := scanTree(root, skip)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(WATCH_POLL_INTERVAL):
+			}
+			current := scanTree(root, skip)
+			var created, deleted []string
+			for path, entry := range current {
+				old, ok := previous[path]
+				if !ok {
+					created = append(created, path)
+				} else if !entry.isDir && (!old.modTime.Equal(entry.modTime) || old.size != entry.size) {
+					if !sendWatchEvent(events, done, WatchEvent{"modify", path, ""}) {
+						return
+					}
+				}
+			}
+			for path := range previous {
+				if _, ok := current[path]; !ok {
+					deleted = append(deleted, path)
+				}
+			}
+			for _, path := range created {
+				event := WatchEvent{"create", path, ""}
+				entry := current[path]
+				for i, from := range deleted {
+					old := previous[from]
+					if !entry.isDir && !old.isDir && old.size == entry.size && old.modTime.Equal(entry.modTime) {
+						event = WatchEvent{"rename", path, from}
+						deleted = append(deleted[:i], deleted[i+1:]...)
+						break
+					}
+				}
+				if !sendWatchEvent(events, done, event) {
+					return
+				}
+			}
+			for _, path := range deleted {
+				if !sendWatchEvent(events, done, WatchEvent{"delete", path, ""}) {
+					return
+				}
+			}
+			previous = current
+		}
+	}()
+	return events, nil
+}
+
+func sendWatchEvent(events chan WatchEvent, done chan bool, event WatchEvent) bool {
+	select {
+	case events <- event:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// Streams change events below dirPath as JSON lines until the request is
+// cancelled. Honors the path rules and the filelist excludes.
+func (self *RootedRPCHandler) handleWatch(dirPath string, queryValues url.Values, requestChannel chan []byte, responseChannel chan []byte) HttpError {
+	exclude := parseWalkOptions(queryValues, self.walkExcludes).exclude
+	skip := func(absPath string, isDir bool) bool {
+		return self.isHidden(absPath, isDir) || exclude.ignores(relativeTo(dirPath, absPath), isDir)
+	}
+	done := cancelNotifier(requestChannel)
+	events, err := self.fs.Watch(dirPath, skip, done)
+	if err != nil {
+		return NewHttpError(500, "Could not watch directory: "+err.Error())
+	}
+
+	responseChannel <- statusCodeBuffer(200)
+	responseChannel <- headerBuffer(map[string]string{
+		"Content-Type": "application/x-ndjson",
+	})
+	for event := range events {
+		event.Path = "/" + relativeTo(dirPath, event.Path)
+		if event.From != "" {
+			event.From = "/" + relativeTo(dirPath, event.From)
+		}
+		line, _ := json.Marshal(event)
+		responseChannel <- append(line, '\n')
+	}
+	return nil
+}
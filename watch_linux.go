@@ -0,0 +1,188 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF
+
+type inotifyWatcher struct {
+	fd     int
+	file   *os.File
+	skip   watchFilter
+	events chan WatchEvent
+	done   chan bool
+	// Watch descriptor to directory path
+	paths map[int32]string
+}
+
+// Watches the tree with inotify, one watch per directory
+func nativeWatchTree(root string, skip watchFilter, done chan bool) (chan WatchEvent, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &inotifyWatcher{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		skip:   skip,
+		events: make(chan WatchEvent),
+		done:   done,
+		paths:  make(map[int32]string),
+	}
+	if err := w.addDirectory(root, false); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	go func() {
+		<-done
+		// Unblocks the pending read
+		w.file.Close()
+	}()
+	go w.readEvents()
+	return w.events, nil
+}
+
+// Adds watches for dir and all directories below it. With announce, files
+// found are reported as created, for directories moved or created in the tree.
+func (w *inotifyWatcher) addDirectory(dir string, announce bool) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+	if err != nil {
+		return err
+	}
+	w.paths[int32(wd)] = dir
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		if w.skip(path, f.IsDir()) {
+			continue
+		}
+		if announce && !w.send(WatchEvent{"create", path, ""}) {
+			return nil
+		}
+		if f.IsDir() {
+			w.addDirectory(path, announce)
+		}
+	}
+	return nil
+}
+
+// Updates the paths of watched directories after a directory was moved
+func (w *inotifyWatcher) moveDirectory(from string, to string) {
+	for wd, path := range w.paths {
+		if path == from {
+			w.paths[wd] = to
+		} else if strings.HasPrefix(path, from+"/") {
+			w.paths[wd] = to + path[len(from):]
+		}
+	}
+}
+
+func (w *inotifyWatcher) send(event WatchEvent) bool {
+	return sendWatchEvent(w.events, w.done, event)
+}
+
+func (w *inotifyWatcher) readEvents() {
+	defer close(w.events)
+	buffer := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buffer)
+		if err != nil {
+			return
+		}
+		// Cookie to source path of moves, waiting for their other half
+		movedFrom := make(map[uint32]string)
+		movedFromDirs := make(map[uint32]bool)
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			nameBytes := buffer[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(raw.Len)]
+			offset += syscall.SizeofInotifyEvent + int(raw.Len)
+
+			if raw.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.paths, raw.Wd)
+				continue
+			}
+			dir, ok := w.paths[raw.Wd]
+			if !ok || raw.Len == 0 {
+				continue
+			}
+			path := filepath.Join(dir, strings.TrimRight(string(nameBytes), "\x00"))
+			isDir := raw.Mask&syscall.IN_ISDIR != 0
+			if w.skip(path, isDir) {
+				continue
+			}
+
+			var event WatchEvent
+			switch {
+			case raw.Mask&syscall.IN_CREATE != 0:
+				event = WatchEvent{"create", path, ""}
+				if isDir {
+					if !w.send(event) {
+						return
+					}
+					w.addDirectory(path, true)
+					continue
+				}
+			case raw.Mask&syscall.IN_CLOSE_WRITE != 0:
+				event = WatchEvent{"modify", path, ""}
+			case raw.Mask&syscall.IN_DELETE != 0:
+				event = WatchEvent{"delete", path, ""}
+			case raw.Mask&syscall.IN_MOVED_FROM != 0:
+				movedFrom[raw.Cookie] = path
+				movedFromDirs[raw.Cookie] = isDir
+				continue
+			case raw.Mask&syscall.IN_MOVED_TO != 0:
+				from, ok := movedFrom[raw.Cookie]
+				if ok {
+					delete(movedFrom, raw.Cookie)
+					event = WatchEvent{"rename", path, from}
+					if isDir {
+						w.moveDirectory(from, path)
+					}
+				} else {
+					// Moved in from outside of the tree
+					event = WatchEvent{"create", path, ""}
+					if isDir {
+						if !w.send(event) {
+							return
+						}
+						w.addDirectory(path, true)
+						continue
+					}
+				}
+			default:
+				continue
+			}
+			if !w.send(event) {
+				return
+			}
+		}
+		// Moved out of the tree
+		for cookie, path := range movedFrom {
+			if movedFromDirs[cookie] {
+				w.removeDirectory(path)
+			}
+			if !w.send(WatchEvent{"delete", path, ""}) {
+				return
+			}
+		}
+	}
+}
+
+func (w *inotifyWatcher) removeDirectory(dir string) {
+	for wd, path := range w.paths {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.paths, wd)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func nativeWatchTree(root string, skip watchFilter, done chan bool) (chan WatchEvent, error) {
+	return nil, errors.New("Native file watching not supported on this platform")
+}
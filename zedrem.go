@@ -2,8 +2,6 @@ package main
 
 import (
 	"os"
-	"github.com/pborman/uuid"
-	"strings"
 	"fmt"
 )
 
@@ -21,22 +19,76 @@ func main() {
 		ip, port, sslCrt, sslKey := ParseServerFlags(os.Args[2:])
 		RunServer(ip, port, sslCrt, sslKey, false)
 	case "client":
-		url, userKey, rootPath := ParseClientFlags(os.Args[1:])
-		id := strings.Replace(uuid.New(), "-", "", -1)
-		RunClient(url, id, userKey, rootPath)
+		options := ParseClientFlags(os.Args[1:])
+		id := newSessionId()
+		if options.Persist {
+			session, err := loadSession(options)
+			if err != nil {
+				fmt.Println("Could not save session:", err)
+				os.Exit(4)
+			}
+			id, options.Secret = session.Id, session.Secret
+		}
+		RunClient(id, options)
 	case "help":
 		fmt.Println(`zedrem runs in one of two possible modes: client or server:
 
-Usage: zedrem [-u url] [-key userKey] <dir>
+Usage: zedrem [-u url] [-key userKey] [-readonly] [-rev revision] [-terminal] [-forward port] [-persist] <dir>
+       zedrem [flags] name=<dir> name=<dir>...
        Launches a Zed client and attaches to a Zed server exposing
        directory <dir> (or current directory if omitted). Default URL is
        wss://remote.zedapp.org:443
+       Several directories can be served in one session as name=<dir>,
+       each under /fs/<id>/<name>/ with /fs/<id>/ listing them. A
+       [root "name"] section in ~/.zedremrc can make one read-only or add
+       include and exclude rules for it.
+       With -persist (or persist = true in ~/.zedremrc) the session id is
+       kept in ~/.zedrem/sessions per server URL and directory, so the URL
+       stays the same when the client is restarted. The server only lets
+       a client with the same secret reclaim it.
        If a -key flag is passed that matches the userKey set in your Zed
        configuration, a window will open automatically.
+       With -readonly (or readonly = true in ~/.zedremrc) only reads are
+       allowed, all writes, terminals and language servers are refused
+       with 403 Forbidden.
+       With -rev (e.g. -rev v1.2) the tree of that git revision is served,
+       read-only, instead of the working tree. If <dir> is a .zip, .tar,
+       .tar.gz or .tgz file, the contents of the archive are served
+       read-only. Trash, history, uploads, exec, git, terminals and
+       language servers are only available on the working tree.
+       Which paths are exposed can be limited with gitignore-style include
+       and exclude rules in ~/.zedremrc or in a .zedremrc file in <dir>.
+       Symlinks that lead outside <dir> or to hidden paths are not served.
+       Nothing inside .git can be written, and the git actions ignore the
+       repository settings that would make git run commands.
+       Deleted files are moved into <dir>/.zedrem-trash and purged after
+       trashretention (default 168h), pass -trash=false to delete right away.
+       The last historyversions (default 10) versions of every saved file
+       are kept in ~/.zedrem/history, or in historydir if configured.
+       Unfinished resumable uploads expire after uploadexpiry (default 24h).
+       Commands can only be run remotely when listed with execallow in
+       ~/.zedremrc, e.g. execallow = make.
+       With -terminal the editor can open interactive shells in <dir>.
+       Every -forward port makes localhost:<port> reachable through the
+       relay at /fwd/<id>/<port>/, or as raw TCP over a websocket there
+       with the zedrem-tcp subprotocol.
+       Language servers configured in ~/.zedremrc, e.g.
+         [lsp "go"]
+         command = gopls
+         extension = go
+       run in <dir> on request of the editor.
 
-Usage: zedrem --server [-h ip] [-p port] [--sslcrt file.crt] [--sslkey file.key]
+Usage: zedrem --server [-h ip] [-p port] [--sslcrt file.crt] [--sslkey file.key] [--grace duration]
        Launches a Zed server, binding to IP <ip> on port <port>.
        If --sslcrt and --sslkey are provided, will run in TLS mode for more security.
+       Requests for a client that lost its connection are held for the
+       grace period (default 30s, reconnectgrace in the [server] section of
+       ~/.zedremrc) until it reconnects, then answered with
+       503 Service Unavailable and Retry-After. After that the session is
+       gone and requests for it get 410 Gone.
+       The hashes of the secrets that claimed session ids are kept in
+       ~/.zedrem/session-secrets, so ids stay claimed across restarts of
+       the server until unused for 30 days.
 `)
 	}
 }